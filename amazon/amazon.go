@@ -7,22 +7,29 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"time"
 
-	"github.com/CaboodleData/gotools/file"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/swf"
+	"golang.org/x/net/context"
 )
 
+// SWFAwaitInterval is how often SWFAwaitWorkflow checks if the workflow has closed
+var SWFAwaitInterval = 5 * time.Second
+
+// SWFLambdaRole is the ARN of the IAM role SWF uses to invoke Lambda functions.
+// Set it before starting workflows whose decider schedules Lambda tasks.
+var SWFLambdaRole string
+
 //SESSendEmail use this to send an email fo SES
-func SESSendEmail(from string, to string, subject string, message string) error {
-	svc := ses.New(session.New(&aws.Config{Region: aws.String("us-east-1")}))
+func SESSendEmail(cfg *Config, from string, to string, subject string, message string) error {
+	sess, err := cfg.Session()
+	if err != nil {
+		return err
+	}
+	svc := ses.New(sess)
 
 	params := &ses.SendEmailInput{
 		Destination: &ses.Destination{ // Required
@@ -61,13 +68,31 @@ func SESSendEmail(from string, to string, subject string, message string) error
 }
 
 // SWFNewSession gets new session
-func SWFNewSession(id string, secret string) *swf.SWF {
-	sess := session.New(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.NewStaticCredentials(id, secret, "")})
-	return swf.New(sess)
+func SWFNewSession(cfg *Config) (*swf.SWF, error) {
+	sess, err := cfg.Session()
+	if err != nil {
+		return nil, err
+	}
+	return swf.New(sess), nil
+}
+
+// SQSNewSession returns an SQS client for the config, set Config.Endpoint to use a local stand-in such as ElasticMQ
+func SQSNewSession(cfg *Config) (*sqs.SQS, error) {
+	sess, err := cfg.Session()
+	if err != nil {
+		return nil, err
+	}
+	return sqs.New(sess), nil
 }
 
 // SWFStartWorkflow starts a new workflow
 func SWFStartWorkflow(svc *swf.SWF, domainName string, workflowName string, version string, packageID string, input string, tags []string, tasklist string) (*string, error) {
+	_, runID, err := swfStartWorkflow(svc, domainName, workflowName, version, packageID, input, tags, tasklist)
+	return runID, err
+}
+
+// swfStartWorkflow starts a new workflow, returning its workflow id and run id
+func swfStartWorkflow(svc *swf.SWF, domainName string, workflowName string, version string, packageID string, input string, tags []string, tasklist string) (string, *string, error) {
 	// convert TagList
 	var awstags []*string
 	var id string
@@ -91,8 +116,7 @@ func SWFStartWorkflow(svc *swf.SWF, domainName string, workflowName string, vers
 		},
 		//ChildPolicy:                  aws.String("ChildPolicy"),
 		//ExecutionStartToCloseTimeout: aws.String("DurationInSecondsOptional"),
-		Input: aws.String(input),
-		//LambdaRole: aws.String("Arn"),
+		Input:   aws.String(input),
 		TagList: awstags,
 		//TagList: []*string{
 		//	aws.String(tag), // Required
@@ -103,12 +127,125 @@ func SWFStartWorkflow(svc *swf.SWF, domainName string, workflowName string, vers
 		//TaskPriority:            aws.String("TaskPriority"),
 		//TaskStartToCloseTimeout: aws.String("DurationInSecondsOptional"),
 	}
+	if SWFLambdaRole != "" {
+		params.LambdaRole = aws.String(SWFLambdaRole)
+	}
 	resp, err := svc.StartWorkflowExecution(params)
-	return resp.RunId, err
+	if err != nil {
+		return id, nil, err
+	}
+	return id, resp.RunId, nil
+}
+
+// SWFWorkflowError is returned by SWFAwaitWorkflow when the workflow did not complete
+type SWFWorkflowError struct {
+	WorkflowID  string
+	RunID       string
+	CloseStatus string // FAILED, CANCELED, TERMINATED or TIMED_OUT
+	Reason      string
+	Details     string
+}
+
+func (e *SWFWorkflowError) Error() string {
+	msg := "workflow " + e.WorkflowID + " " + e.CloseStatus
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	if e.Details != "" {
+		msg += ": " + e.Details
+	}
+	return msg
+}
+
+// SWFStartWorkflowAndWait starts a new workflow and waits for it to close, returning its result.
+// Set a deadline on ctx to limit how long to wait, eg. ten minutes for a supplier load.
+func SWFStartWorkflowAndWait(ctx context.Context, svc *swf.SWF, domainName string, workflowName string, version string, packageID string, input string, tags []string, tasklist string) (string, error) {
+	id, runID, err := swfStartWorkflow(svc, domainName, workflowName, version, packageID, input, tags, tasklist)
+	if err != nil {
+		return "", err
+	}
+	return SWFAwaitWorkflow(ctx, svc, domainName, id, *runID)
+}
+
+// SWFAwaitWorkflow waits until the workflow closes, checking every SWFAwaitInterval.
+// It returns the result if the workflow completed, a *SWFWorkflowError if it closed any other way,
+// or the ctx error if the deadline passes first. A workflow that continues as new is followed to its new run.
+func SWFAwaitWorkflow(ctx context.Context, svc *swf.SWF, domainName string, workflowID string, runID string) (string, error) {
+	for {
+		resp, err := svc.DescribeWorkflowExecutionWithContext(ctx, &swf.DescribeWorkflowExecutionInput{
+			Domain: aws.String(domainName),
+			Execution: &swf.WorkflowExecution{
+				WorkflowId: aws.String(workflowID),
+				RunId:      aws.String(runID),
+			},
+		})
+		if err != nil {
+			return "", awaitError(ctx, err)
+		}
+		if aws.StringValue(resp.ExecutionInfo.ExecutionStatus) == swf.ExecutionStatusClosed {
+			return swfWorkflowResult(ctx, svc, domainName, workflowID, runID, aws.StringValue(resp.ExecutionInfo.CloseStatus))
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(SWFAwaitInterval):
+		}
+	}
+}
+
+// awaitError returns the ctx error in place of the SDK's RequestCanceled when the call failed because ctx is done,
+// so callers can check for context.DeadlineExceeded
+func awaitError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// swfWorkflowResult reads the result or failure of a closed workflow from the last event of its history
+func swfWorkflowResult(ctx context.Context, svc *swf.SWF, domainName string, workflowID string, runID string, closeStatus string) (string, error) {
+	resp, err := svc.GetWorkflowExecutionHistoryWithContext(ctx, &swf.GetWorkflowExecutionHistoryInput{
+		Domain: aws.String(domainName),
+		Execution: &swf.WorkflowExecution{
+			WorkflowId: aws.String(workflowID),
+			RunId:      aws.String(runID),
+		},
+		MaximumPageSize: aws.Int64(10),
+		ReverseOrder:    aws.Bool(true),
+	})
+	if err != nil {
+		return "", awaitError(ctx, err)
+	}
+	wfErr := &SWFWorkflowError{WorkflowID: workflowID, RunID: runID, CloseStatus: closeStatus}
+	for _, event := range resp.Events {
+		switch *event.EventType {
+		case "WorkflowExecutionCompleted":
+			return aws.StringValue(event.WorkflowExecutionCompletedEventAttributes.Result), nil
+		case "WorkflowExecutionContinuedAsNew":
+			return SWFAwaitWorkflow(ctx, svc, domainName, workflowID, *event.WorkflowExecutionContinuedAsNewEventAttributes.NewExecutionRunId)
+		case "WorkflowExecutionFailed":
+			wfErr.Reason = aws.StringValue(event.WorkflowExecutionFailedEventAttributes.Reason)
+			wfErr.Details = aws.StringValue(event.WorkflowExecutionFailedEventAttributes.Details)
+			return "", wfErr
+		case "WorkflowExecutionCanceled":
+			wfErr.Details = aws.StringValue(event.WorkflowExecutionCanceledEventAttributes.Details)
+			return "", wfErr
+		case "WorkflowExecutionTerminated":
+			wfErr.Reason = aws.StringValue(event.WorkflowExecutionTerminatedEventAttributes.Reason)
+			wfErr.Details = aws.StringValue(event.WorkflowExecutionTerminatedEventAttributes.Details)
+			return "", wfErr
+		case "WorkflowExecutionTimedOut":
+			wfErr.Reason = aws.StringValue(event.WorkflowExecutionTimedOutEventAttributes.TimeoutType)
+			return "", wfErr
+		}
+	}
+	return "", wfErr
 }
 
 // SWFPollForActivity will poll for up to 10 minutes for the job to load, there after will cancel out.
 // cdecider will schedule the loadcompleted activity under a tasklist for with the supplierid
+//
+// Deprecated: start the workflow with SWFStartWorkflowAndWait instead, which waits for the workflow itself to close.
 func SWFPollForActivity(svc *swf.SWF, domain string, tasklist string, supplierID string, Info *log.Logger, onComplete func(taskname string, input string, tasktoken string)) error {
 	params := &swf.PollForActivityTaskInput{
 		Domain: aws.String(domain), //
@@ -151,77 +288,33 @@ func SWFCompleteActivity(swfsvc *swf.SWF, tt string, result string) error {
 }
 
 // SWFCancelActivity - completes the activity
-func SWFCancelActivity(tt string, details string) error {
-	swfsvc := swf.New(session.New(), &aws.Config{Region: aws.String("us-east-1")})
+func SWFCancelActivity(cfg *Config, tt string, details string) error {
+	swfsvc, err := SWFNewSession(cfg)
+	if err != nil {
+		return err
+	}
 	params := &swf.RespondActivityTaskCanceledInput{
 		TaskToken: aws.String(tt),
 		Details:   aws.String(details),
 	}
-	_, err := swfsvc.RespondActivityTaskCanceled(params)
+	_, err = swfsvc.RespondActivityTaskCanceled(params)
 	return err
 }
 
-// S3SendFile bla
-func S3SendFile(id string, secret string, keyName string, bucketName string, file io.Reader) error {
-	sess := session.New(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.NewStaticCredentials(id, secret, "")})
-	uploader := s3manager.NewUploader(sess)
-
-	// Upload input parameters
-	upParams := &s3manager.UploadInput{
-		Bucket: &bucketName,
-		Key:    &keyName,
-		Body:   file,
-	}
-
-	_, err := uploader.Upload(upParams)
+// S3SendFile bla, see S3Upload for content type, encryption, progress etc.
+func S3SendFile(cfg *Config, keyName string, bucketName string, file io.Reader) error {
+	_, err := S3Upload(cfg, bucketName, keyName, file, nil)
 	return err
-
 }
 
-// S3Download a file from S3 buy sending in the buckey and key to download
-// This needs default credentials to be setup
-func S3Download(bucket string, objectKey string) error {
-	//sess := session.New(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.NewStaticCredentials(id, secret, "")})
-	sess := session.New(&aws.Config{Region: aws.String("us-east-1")})
-	dfile, err := os.Create(objectKey)
-	if err != nil {
-		log.Fatal("Failed to create file", err)
-	}
-	defer dfile.Close()
-
-	downloader := s3manager.NewDownloader(sess)
-	_, err = downloader.Download(dfile,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(objectKey),
-		})
+// S3Download a file from S3 buy sending in the buckey and key to download, it is saved under the key name.
+// See S3DownloadFile to choose where it goes, S3DownloadTo and S3DownloadStream for writers.
+func S3Download(cfg *Config, bucket string, objectKey string) error {
+	_, err := S3DownloadFile(cfg, bucket, objectKey, objectKey, nil)
 	return err
 }
 
-// S3DownloadUnMarshal downloads a file from S3, but also unmarshals into a structure
-// This needs default credentials to be setup
-func S3DownloadUnMarshal(bucket string, objectKey string, s interface{}) error {
-	//sess := session.New(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.NewStaticCredentials(id, secret, "")})
-	sess := session.New(&aws.Config{Region: aws.String("us-east-1")})
-
-	dfile, err := os.Create(objectKey)
-	if err != nil {
-		log.Fatal("Failed to create file", err)
-	}
-	defer dfile.Close()
-
-	downloader := s3manager.NewDownloader(sess)
-	_, err = downloader.Download(dfile,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(objectKey),
-		})
-	if err != nil {
-		return err
-	}
-	if err = file.LoadJSON(dfile.Name(), &s); err != nil {
-		return err
-	}
-	err = os.Remove(dfile.Name())
-	return err
+// S3DownloadUnMarshal downloads a JSON file from S3 straight into a structure, s must be a pointer
+func S3DownloadUnMarshal(cfg *Config, bucket string, objectKey string, s interface{}) error {
+	return S3DecodeJSON(cfg, bucket, objectKey, s)
 }
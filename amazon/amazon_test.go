@@ -0,0 +1,54 @@
+package amazon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	"golang.org/x/net/context"
+)
+
+func testSWF(t *testing.T, handler http.HandlerFunc) (*swf.SWF, func()) {
+	server := httptest.NewServer(handler)
+	cfg := &Config{Region: "us-east-1", Endpoint: server.URL, AccessKeyID: "test", SecretAccessKey: "test", MaxRetries: 1}
+	sess, err := cfg.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return swf.New(sess), server.Close
+}
+
+func TestSWFAwaitWorkflowDeadline(t *testing.T) {
+	// SWF takes longer to answer than the deadline allows
+	done := make(chan struct{})
+	svc, stop := testSWF(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	defer stop()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := SWFAwaitWorkflow(ctx, svc, "rapidtrade", "supplierload-1234", "22Qz5Dl7mLqz"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSWFAwaitWorkflowError(t *testing.T) {
+	svc, stop := testSWF(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.swf.base.model#UnknownResourceFault","message":"Unknown execution"}`))
+	})
+	defer stop()
+
+	_, err := SWFAwaitWorkflow(context.Background(), svc, "rapidtrade", "supplierload-1234", "22Qz5Dl7mLqz")
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		t.Errorf("got %v, want the SWF error", err)
+	}
+}
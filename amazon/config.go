@@ -0,0 +1,99 @@
+package amazon
+
+import (
+	"sync"
+
+	"github.com/CaboodleData/gotools/file"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// DefaultRegion is used when the Config does not set a region
+const DefaultRegion = "us-east-1"
+
+// Config is the AWS configuration passed into every amazon and workflow function.
+// Credentials are picked as follows: static keys if AccessKeyID is set, else the Profile from the shared
+// credentials file, else the environment if UseEnv is set, else the SDK default chain (env, shared file, instance role).
+// If RoleARN is set, that role is assumed using the credentials picked.
+// A nil *Config is the same as an empty one, ie. us-east-1 with default credentials.
+type Config struct {
+	Region   string `json:"region"`
+	Endpoint string `json:"endpoint"` // custom endpoint, eg. http://localhost:4566 to test against LocalStack
+	Profile  string `json:"profile"`
+
+	AccessKeyID     string `json:"accesskey"`
+	SecretAccessKey string `json:"secret"`
+	SessionToken    string `json:"sessiontoken"`
+	UseEnv          bool   `json:"useenv"`
+	RoleARN         string `json:"rolearn"`
+
+	MaxRetries int  `json:"maxretries"` // 0 uses the SDK default
+	PathStyle  bool `json:"pathstyle"`  // use path style S3 urls, which most S3 emulators need
+
+	mu   sync.Mutex
+	sess *session.Session
+}
+
+// LoadConfig loads the config from a JSON file as follows:
+// {"region":"eu-west-1","endpoint":"http://localhost:4566","accesskey":"test","secret":"test","pathstyle":true}
+func LoadConfig(fileName string) (*Config, error) {
+	c := &Config{}
+	if err := file.LoadJSON(fileName, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetRegion returns the region, or DefaultRegion if none is set
+func (c *Config) GetRegion() string {
+	if c == nil || c.Region == "" {
+		return DefaultRegion
+	}
+	return c.Region
+}
+
+// Session returns the AWS session for this config, it is created once and then shared
+func (c *Config) Session() (*session.Session, error) {
+	if c == nil {
+		return session.NewSession(&aws.Config{Region: aws.String(DefaultRegion)})
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil {
+		return c.sess, nil
+	}
+
+	awsConfig := &aws.Config{Region: aws.String(c.GetRegion())}
+	if c.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(c.Endpoint)
+	}
+	if c.MaxRetries > 0 {
+		awsConfig.MaxRetries = aws.Int(c.MaxRetries)
+	}
+	if c.PathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	switch {
+	case c.AccessKeyID != "":
+		awsConfig.Credentials = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, c.SessionToken)
+	case c.Profile != "":
+		awsConfig.Credentials = credentials.NewSharedCredentials("", c.Profile)
+	case c.UseEnv:
+		awsConfig.Credentials = credentials.NewEnvCredentials()
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if c.RoleARN != "" {
+		sess, err = session.NewSession(awsConfig.Copy().WithCredentials(stscreds.NewCredentials(sess, c.RoleARN)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.sess = sess
+	return sess, nil
+}
@@ -0,0 +1,284 @@
+package amazon
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Open opens an object for reading as it downloads, nothing is written to disk. If the object is gzipped,
+// going by its Content-Encoding, Content-Type or a .gz key, it is decompressed as it is read. Close it when done.
+func S3Open(cfg *Config, bucket string, key string) (io.ReadCloser, error) {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	gzipped := strings.EqualFold(aws.StringValue(out.ContentEncoding), "gzip") ||
+		strings.EqualFold(path.Ext(key), ".gz") ||
+		strings.Contains(aws.StringValue(out.ContentType), "gzip")
+	if !gzipped {
+		return out.Body, nil
+	}
+	// Go's http client may already have decompressed a gzip Content-Encoding, so check the magic number first
+	br := bufio.NewReader(out.Body)
+	if magic, err := br.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return &readCloser{Reader: br, Closer: out.Body}, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		out.Body.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: gz, Closer: out.Body}, nil
+}
+
+// readCloser reads from a wrapping reader and closes the underlying body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// S3DecodeJSON decodes a JSON object straight into v, which must be a pointer, eg.
+//
+//	var cfg SupplierConfig
+//	err := amazon.S3DecodeJSON(awscfg, "rapidtradeconfig", supplierID+".json", &cfg)
+func S3DecodeJSON(cfg *Config, bucket string, key string, v interface{}) error {
+	r, err := S3Open(cfg, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// S3NDJSONIterator reads newline delimited JSON, one value at a time, eg.
+//
+//	it := amazon.S3NDJSON(cfg, "rapidtradeinbox", "orders/20170301.ndjson.gz")
+//	defer it.Close()
+//	for it.Next() {
+//		var o Order
+//		err := it.Decode(&o)
+//	}
+//	if err := it.Err(); err != nil {
+type S3NDJSONIterator struct {
+	r    io.ReadCloser
+	dec  *json.Decoder
+	cur  json.RawMessage
+	line int
+	err  error
+}
+
+// S3NDJSON opens a newline delimited JSON object for reading a line at a time
+func S3NDJSON(cfg *Config, bucket string, key string) *S3NDJSONIterator {
+	r, err := S3Open(cfg, bucket, key)
+	if err != nil {
+		return &S3NDJSONIterator{err: err}
+	}
+	return &S3NDJSONIterator{r: r, dec: json.NewDecoder(r)}
+}
+
+// Next reads the next value, it returns false at the end or on an error
+func (it *S3NDJSONIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.cur = nil
+	if err := it.dec.Decode(&it.cur); err != nil {
+		if err != io.EOF {
+			it.err = fmt.Errorf("line %d: %v", it.line+1, err)
+		}
+		return false
+	}
+	it.line++
+	return true
+}
+
+// Decode decodes the current value into v
+func (it *S3NDJSONIterator) Decode(v interface{}) error {
+	if err := json.Unmarshal(it.cur, v); err != nil {
+		return fmt.Errorf("line %d: %v", it.line, err)
+	}
+	return nil
+}
+
+// Raw is the current value undecoded
+func (it *S3NDJSONIterator) Raw() json.RawMessage {
+	return it.cur
+}
+
+// Err is the error that stopped Next, if any
+func (it *S3NDJSONIterator) Err() error {
+	return it.err
+}
+
+// Close stops the download
+func (it *S3NDJSONIterator) Close() error {
+	if it.r == nil {
+		return nil
+	}
+	return it.r.Close()
+}
+
+// S3DecodeCSV decodes a CSV object with a header row into out, a pointer to a slice of structs.
+// Columns are matched to fields by a csv tag, or else the field name ignoring case, other columns are skipped, eg.
+//
+//	type Sale struct {
+//		SupplierID string    `csv:"supplier_id"`
+//		OrderDate  time.Time `csv:"order_date"` // RFC3339 or 2006-01-02
+//		Quantity   int
+//		Value      float64
+//	}
+//	var sales []Sale
+//	err := amazon.S3DecodeCSV(cfg, "rapidtradeinbox", "sales.csv.gz", &sales)
+func S3DecodeCSV(cfg *Config, bucket string, key string, out interface{}) error {
+	slice := reflect.ValueOf(out)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return errors.New("S3DecodeCSV needs a pointer to a slice of structs")
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return errors.New("S3DecodeCSV needs a pointer to a slice of structs")
+	}
+
+	r, err := S3Open(cfg, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	record, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	header := append([]string(nil), record...) // the reader reuses record
+	fields := csvFields(elemType, header)
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		elem := reflect.New(elemType).Elem()
+		for col, field := range fields {
+			if field < 0 || col >= len(record) {
+				continue
+			}
+			if err = setField(elem.Field(field), record[col]); err != nil {
+				return fmt.Errorf("line %d, %s: %v", line, header[col], err)
+			}
+		}
+		if isPtr {
+			elem = elem.Addr()
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+}
+
+// csvFields returns the struct field index for each column, -1 for columns with no field
+func csvFields(t reflect.Type, header []string) []int {
+	fields := make([]int, len(header))
+	for col, name := range header {
+		fields[col] = -1
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			tag := f.Tag.Get("csv")
+			if tag == "-" {
+				continue
+			}
+			if tag == name || (tag == "" && strings.EqualFold(f.Name, name)) {
+				fields[col] = i
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// setField parses a CSV value into a field, an empty value leaves the zero value
+func setField(v reflect.Value, s string) error {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		p := reflect.New(v.Type().Elem())
+		if err := setField(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+	if _, ok := v.Interface().(time.Time); ok {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", s); err != nil {
+				return err
+			}
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
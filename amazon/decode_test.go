@@ -0,0 +1,106 @@
+package amazon
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type csvSale struct {
+	SupplierID string    `csv:"supplier_id"`
+	OrderDate  time.Time `csv:"order_date"`
+	Quantity   int
+	Value      float64
+	Paid       *bool
+	Notes      string `csv:"-"`
+	internal   string
+}
+
+// testS3 serves body for every object, with an S3 config pointing at it
+func testS3(body *string) (*Config, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, *body)
+	}))
+	cfg := &Config{Region: "us-east-1", Endpoint: server.URL, AccessKeyID: "test", SecretAccessKey: "test", PathStyle: true}
+	return cfg, server.Close
+}
+
+func TestS3DecodeCSV(t *testing.T) {
+	paid := true
+	march := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		csv  string
+		want []csvSale
+		err  string // part of the error expected, "" for none
+	}{
+		{"header mapping", "\ufeffsupplier_id,order_date,QUANTITY, value ,notes,internal\n1234,2017-03-01,5,12.50,sent,x\n",
+			[]csvSale{{SupplierID: "1234", OrderDate: march, Quantity: 5, Value: 12.5}}, ""},
+		{"tag is not matched ignoring case", "SUPPLIER_ID,supplierid\n1234,5678\n", []csvSale{{}}, ""},
+		{"types", "supplier_id,order_date,paid,quantity\n1234,2017-03-01T06:00:00Z,true,-3\n",
+			[]csvSale{{SupplierID: "1234", OrderDate: march.Add(6 * time.Hour), Paid: &paid, Quantity: -3}}, ""},
+		{"empty values", "supplier_id,order_date,paid,quantity,value\n1234, ,,,\n", []csvSale{{SupplierID: "1234"}}, ""},
+		{"extra columns", "supplier_id,region,quantity,rep\n1234,gauteng,5,shaun\n5678,cape,6,thabo\n",
+			[]csvSale{{SupplierID: "1234", Quantity: 5}, {SupplierID: "5678", Quantity: 6}}, ""},
+		{"missing columns", "quantity\n5\n", []csvSale{{Quantity: 5}}, ""},
+		{"header only", "supplier_id,quantity\n", nil, ""},
+		{"bad int", "supplier_id,quantity\n1234,5\n5678,five\n", nil, "line 3, quantity"},
+		{"bad float", "value\n12.5.0\n", nil, "line 2, value"},
+		{"bad bool", "paid\nyes\n", nil, "line 2, paid"},
+		{"bad date", "order_date\n01/03/2017\n", nil, "line 2, order_date"},
+		{"short row", "supplier_id,quantity\n1234\n", nil, "wrong number of fields"},
+		{"long row", "supplier_id,quantity\n1234,5,6\n", nil, "wrong number of fields"},
+		{"empty", "", nil, io.EOF.Error()},
+	}
+	var body string
+	cfg, stop := testS3(&body)
+	defer stop()
+	for _, tt := range tests {
+		body = tt.csv
+		var sales []csvSale
+		err := S3DecodeCSV(cfg, "rapidtradeinbox", "sales.csv", &sales)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(sales, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, sales, tt.want)
+		}
+	}
+}
+
+func TestS3DecodeCSVPointers(t *testing.T) {
+	body := "supplier_id,quantity\n1234,5\n"
+	cfg, stop := testS3(&body)
+	defer stop()
+	var sales []*csvSale
+	if err := S3DecodeCSV(cfg, "rapidtradeinbox", "sales.csv", &sales); err != nil {
+		t.Fatal(err)
+	}
+	if len(sales) != 1 || sales[0].SupplierID != "1234" || sales[0].Quantity != 5 {
+		t.Errorf("got %+v", sales)
+	}
+}
+
+func TestS3DecodeCSVOut(t *testing.T) {
+	var sales []csvSale
+	var count int
+	for _, out := range []interface{}{sales, &count, &[]string{}, nil} {
+		// these fail before S3 is used
+		if err := S3DecodeCSV(nil, "rapidtradeinbox", "sales.csv", out); err == nil {
+			t.Errorf("%T: expected an error", out)
+		}
+	}
+}
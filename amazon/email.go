@@ -0,0 +1,353 @@
+package amazon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// Email is a message with any number of recipients, separate HTML and text bodies, inline images and attachments.
+// Use Bytes to build the MIME message, or SESSendRawEmail to send it, eg.
+//
+//	e := amazon.NewEmail("support@rapidtrade.biz", "Monthly sales", "shaun@rapidtrade.biz")
+//	e.CC = []string{"sales@rapidtrade.biz"}
+//	e.HTML = "<p>Sales attached</p><img src=\"cid:logo\">"
+//	e.Text = "Sales attached"
+//	e.Embed("logo", "logo.png")
+//	e.AttachFile(csvfilename)
+//	err := amazon.SESSendRawEmail(cfg, e)
+type Email struct {
+	From    string
+	To      []string
+	CC      []string
+	BCC     []string
+	ReplyTo []string
+	Subject string
+	HTML    string
+	Text    string
+
+	Attachments []*Attachment
+	Inline      []*Attachment // images referenced in the HTML as cid:ContentID
+}
+
+// Attachment is a file attached to, or embedded in, an Email
+type Attachment struct {
+	Name        string
+	ContentType string // worked out from the Name extension if empty
+	ContentID   string // only for inline attachments
+	Data        []byte
+}
+
+// NewEmail sets up the struc
+func NewEmail(from string, subject string, to ...string) *Email {
+	return &Email{From: from, Subject: subject, To: to}
+}
+
+// Attach adds an attachment from memory
+func (e *Email) Attach(name string, data []byte) *Attachment {
+	a := &Attachment{Name: name, Data: data}
+	e.Attachments = append(e.Attachments, a)
+	return a
+}
+
+// AttachFile adds a file as an attachment, eg. the CSV from sql.DownloadCSV
+func (e *Email) AttachFile(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	e.Attach(filepath.Base(fileName), data)
+	return nil
+}
+
+// Embed adds an inline image from a file, reference it in the HTML as <img src="cid:contentID">
+func (e *Email) Embed(contentID string, fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	e.Inline = append(e.Inline, &Attachment{Name: filepath.Base(fileName), ContentID: contentID, Data: data})
+	return nil
+}
+
+// Recipients is everyone the email goes to, including BCC
+func (e *Email) Recipients() []string {
+	var all []string
+	all = append(all, e.To...)
+	all = append(all, e.CC...)
+	all = append(all, e.BCC...)
+	return all
+}
+
+// Bytes builds the MIME message. BCC recipients are left out of the headers, so pass Recipients to the transport.
+func (e *Email) Bytes() ([]byte, error) {
+	if e.From == "" {
+		return nil, errors.New("email has no from address")
+	}
+	if len(e.Recipients()) == 0 {
+		return nil, errors.New("email has no recipients")
+	}
+
+	var buf bytes.Buffer
+	for _, h := range []struct {
+		key       string
+		addresses []string
+	}{{"From", []string{e.From}}, {"To", e.To}, {"Cc", e.CC}, {"Reply-To", e.ReplyTo}} {
+		if len(h.addresses) == 0 {
+			continue
+		}
+		value, err := formatAddresses(h.addresses)
+		if err != nil {
+			return nil, err
+		}
+		writeHeader(&buf, h.key, value)
+	}
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	writeHeader(&buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageID(e.From))
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	// the parts nest as mixed(related(alternative(text, html), inline images), attachments),
+	// leaving out any level that has only one part
+	var err error
+	switch {
+	case len(e.Attachments) > 0:
+		err = e.writeMixed(&buf)
+	case len(e.Inline) > 0:
+		err = e.writeRelated(&buf, nil)
+	default:
+		err = e.writeAlternative(&buf, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMixed writes the body followed by the attachments
+func (e *Email) writeMixed(buf *bytes.Buffer) error {
+	mw := multipart.NewWriter(buf)
+	writeHeader(buf, "Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+	var err error
+	if len(e.Inline) > 0 {
+		err = e.writeRelated(nil, mw)
+	} else {
+		err = e.writeAlternative(nil, mw)
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range e.Attachments {
+		h := attachmentHeader(a)
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+		if err = writeBase64Part(mw, h, a.Data); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// writeRelated writes the text and HTML followed by the inline images, either at the top level into buf or as a part of parent
+func (e *Email) writeRelated(buf *bytes.Buffer, parent *multipart.Writer) error {
+	w, err := nestedWriter(buf, parent, "multipart/related")
+	if err != nil {
+		return err
+	}
+	if err = e.writeAlternative(nil, w); err != nil {
+		return err
+	}
+	for _, a := range e.Inline {
+		h := attachmentHeader(a)
+		h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.Name}))
+		h.Set("Content-ID", "<"+a.ContentID+">")
+		if err = writeBase64Part(w, h, a.Data); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// writeAlternative writes the text and HTML bodies, if there is only one of them it is written on its own
+func (e *Email) writeAlternative(buf *bytes.Buffer, parent *multipart.Writer) error {
+	var parts []textproto.MIMEHeader
+	var bodies []string
+	if e.Text != "" || e.HTML == "" {
+		parts = append(parts, textHeader("text/plain"))
+		bodies = append(bodies, e.Text)
+	}
+	if e.HTML != "" {
+		parts = append(parts, textHeader("text/html"))
+		bodies = append(bodies, e.HTML)
+	}
+
+	if len(parts) == 1 {
+		if parent != nil {
+			pw, err := parent.CreatePart(parts[0])
+			if err != nil {
+				return err
+			}
+			return writeQuotedPrintable(pw, bodies[0])
+		}
+		for k := range parts[0] {
+			writeHeader(buf, k, parts[0].Get(k))
+		}
+		buf.WriteString("\r\n")
+		return writeQuotedPrintable(buf, bodies[0])
+	}
+
+	w, err := nestedWriter(buf, parent, "multipart/alternative")
+	if err != nil {
+		return err
+	}
+	for i, h := range parts {
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if err = writeQuotedPrintable(pw, bodies[i]); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// nestedWriter starts a multipart body, either at the top level of buf or as a part of parent
+func nestedWriter(buf *bytes.Buffer, parent *multipart.Writer, contentType string) (*multipart.Writer, error) {
+	if parent == nil {
+		w := multipart.NewWriter(buf)
+		writeHeader(buf, "Content-Type", contentType+"; boundary="+w.Boundary())
+		buf.WriteString("\r\n")
+		return w, nil
+	}
+	// make the boundary first so the part header can carry it
+	var boundary bytes.Buffer
+	w := multipart.NewWriter(&boundary)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; boundary="+w.Boundary())
+	pw, err := parent.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	nested := multipart.NewWriter(pw)
+	if err = nested.SetBoundary(w.Boundary()); err != nil {
+		return nil, err
+	}
+	return nested, nil
+}
+
+func textHeader(contentType string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return h
+}
+
+func attachmentHeader(a *Attachment) textproto.MIMEHeader {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Name))
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	params["name"] = a.Name
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	h.Set("Content-Transfer-Encoding", "base64")
+	return h
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// writeBase64Part writes data as base64 in lines of 76 characters
+func writeBase64Part(mw *multipart.Writer, h textproto.MIMEHeader, data []byte) error {
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err = io.WriteString(pw, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(pw, encoded+"\r\n")
+	return err
+}
+
+func writeHeader(buf *bytes.Buffer, key string, value string) {
+	buf.WriteString(key + ": " + value + "\r\n")
+}
+
+// formatAddresses encodes any names in the addresses, an address that does not parse is an error
+// so nothing, such as a line break, can be written into the headers as it is
+func formatAddresses(addresses []string) (string, error) {
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		a, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", fmt.Errorf("invalid email address %q: %v", address, err)
+		}
+		formatted[i] = a.String()
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+func messageID(from string) string {
+	domain := "localhost"
+	if a, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(a.Address, "@"); i >= 0 {
+			domain = a.Address[i+1:]
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// SESSendRawEmail sends an Email through SES, with its attachments and inline images
+func SESSendRawEmail(cfg *Config, e *Email) error {
+	data, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	sess, err := cfg.Session()
+	if err != nil {
+		return err
+	}
+	var destinations []*string
+	for _, r := range e.Recipients() {
+		destinations = append(destinations, aws.String(r))
+	}
+	_, err = ses.New(sess).SendRawEmail(&ses.SendRawEmailInput{
+		Source:       aws.String(e.From),
+		Destinations: destinations,
+		RawMessage:   &ses.RawMessage{Data: data},
+	})
+	return err
+}
@@ -0,0 +1,196 @@
+package amazon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// mimeTree parses a message built by Email.Bytes into its structure, eg. mixed(alternative(text/plain,text/html),text/csv),
+// collecting the decoded body of each leaf part by content type
+func mimeTree(t *testing.T, msg []byte) (string, map[string]string) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := make(map[string]string)
+	tree := mimePart(t, m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body, bodies)
+	return tree, bodies
+}
+
+func mimePart(t *testing.T, contentType string, encoding string, r io.Reader, bodies map[string]string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		if encoding == "base64" {
+			r = base64.NewDecoder(base64.StdEncoding, r)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies[mediaType] = string(b)
+		return mediaType
+	}
+	var children []string
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NextPart decodes quoted-printable and drops the header, so only base64 is left to us
+		children = append(children, mimePart(t, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p, bodies))
+	}
+	return strings.TrimPrefix(mediaType, "multipart/") + "(" + strings.Join(children, ",") + ")"
+}
+
+func TestEmailBytes(t *testing.T) {
+	csv := []byte(strings.Repeat("supplier,orders\n1234,56\n", 10))
+	png := []byte("\x89PNG\r\n\x1a\n not really an image")
+
+	tests := []struct {
+		name  string
+		email func() *Email
+		tree  string
+	}{
+		{"text only", func() *Email {
+			e := NewEmail("support@rapidtrade.biz", "Sales", "shaun@rapidtrade.biz")
+			e.Text = "Sales attached"
+			return e
+		}, "text/plain"},
+		{"html only", func() *Email {
+			e := NewEmail("support@rapidtrade.biz", "Sales", "shaun@rapidtrade.biz")
+			e.HTML = "<p>Sales attached</p>"
+			return e
+		}, "text/html"},
+		{"alternative", func() *Email {
+			e := NewEmail("support@rapidtrade.biz", "Sales", "shaun@rapidtrade.biz")
+			e.Text = "Sales attached"
+			e.HTML = "<p>Sales attached</p>"
+			return e
+		}, "alternative(text/plain,text/html)"},
+		{"related", func() *Email {
+			e := NewEmail("support@rapidtrade.biz", "Sales", "shaun@rapidtrade.biz")
+			e.Text = "Sales attached"
+			e.HTML = `<p>Sales attached</p><img src="cid:logo">`
+			e.Inline = append(e.Inline, &Attachment{Name: "logo.png", ContentID: "logo", Data: png})
+			return e
+		}, "related(alternative(text/plain,text/html),image/png)"},
+		{"mixed", func() *Email {
+			e := NewEmail("support@rapidtrade.biz", "Sales", "shaun@rapidtrade.biz")
+			e.Text = "Sales attached"
+			e.HTML = "<p>Sales attached</p>"
+			e.Attach("sales.csv", csv)
+			return e
+		}, "mixed(alternative(text/plain,text/html),text/csv)"},
+		{"mixed related", func() *Email {
+			e := NewEmail("support@rapidtrade.biz", "Sales", "shaun@rapidtrade.biz")
+			e.Text = "Sales attached"
+			e.HTML = `<p>Sales attached</p><img src="cid:logo">`
+			e.Inline = append(e.Inline, &Attachment{Name: "logo.png", ContentID: "logo", Data: png})
+			e.Attach("sales.csv", csv)
+			return e
+		}, "mixed(related(alternative(text/plain,text/html),image/png),text/csv)"},
+		{"mixed text only", func() *Email {
+			e := NewEmail("support@rapidtrade.biz", "Sales", "shaun@rapidtrade.biz")
+			e.Text = "Sales attached"
+			e.Attach("sales.csv", csv)
+			return e
+		}, "mixed(text/plain,text/csv)"},
+	}
+	for _, tt := range tests {
+		e := tt.email()
+		b, err := e.Bytes()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		tree, bodies := mimeTree(t, b)
+		if tree != tt.tree {
+			t.Errorf("%s: got %s, want %s", tt.name, tree, tt.tree)
+			continue
+		}
+		if e.Text != "" && bodies["text/plain"] != e.Text {
+			t.Errorf("%s: got text %q, want %q", tt.name, bodies["text/plain"], e.Text)
+		}
+		if e.HTML != "" && bodies["text/html"] != e.HTML {
+			t.Errorf("%s: got html %q, want %q", tt.name, bodies["text/html"], e.HTML)
+		}
+		if len(e.Attachments) > 0 && bodies["text/csv"] != string(csv) {
+			t.Errorf("%s: attachment did not decode to what was attached", tt.name)
+		}
+		if len(e.Inline) > 0 && bodies["image/png"] != string(png) {
+			t.Errorf("%s: inline image did not decode to what was embedded", tt.name)
+		}
+	}
+}
+
+func TestEmailHeaders(t *testing.T) {
+	e := NewEmail("Support <support@rapidtrade.biz>", "Ventes été", "shaun@rapidtrade.biz", "sales@rapidtrade.biz")
+	e.CC = []string{"accounts@rapidtrade.biz"}
+	e.BCC = []string{"audit@rapidtrade.biz"}
+	e.Text = "Sales attached"
+	b, err := e.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := m.Header.AddressList("To")
+	if err != nil || len(to) != 2 {
+		t.Errorf("got To %v, %v", to, err)
+	}
+	if cc, err := m.Header.AddressList("Cc"); err != nil || len(cc) != 1 {
+		t.Errorf("got Cc %v, %v", cc, err)
+	}
+	if m.Header.Get("Bcc") != "" || bytes.Contains(b, []byte("audit@")) {
+		t.Error("BCC recipient is in the message")
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != e.Subject {
+		t.Errorf("got subject %q, %v", subject, err)
+	}
+	if len(e.Recipients()) != 4 {
+		t.Errorf("got %d recipients, want 4", len(e.Recipients()))
+	}
+}
+
+func TestEmailBytesErrors(t *testing.T) {
+	if _, err := NewEmail("", "Sales", "shaun@rapidtrade.biz").Bytes(); err == nil {
+		t.Error("expected an error without a from address")
+	}
+	if _, err := NewEmail("support@rapidtrade.biz", "Sales").Bytes(); err == nil {
+		t.Error("expected an error without recipients")
+	}
+
+	// an address that does not parse must not be written into the headers, where a line break would add its own
+	injected := "shaun@rapidtrade.biz\r\nBcc: attacker@example.com"
+	tests := []struct {
+		name string
+		e    *Email
+	}{
+		{"from", NewEmail(injected, "Sales", "shaun@rapidtrade.biz")},
+		{"to", NewEmail("support@rapidtrade.biz", "Sales", injected)},
+		{"cc", &Email{From: "support@rapidtrade.biz", To: []string{"shaun@rapidtrade.biz"}, CC: []string{"accounts@rapidtrade.biz\nX-Spam: no"}}},
+		{"reply to", &Email{From: "support@rapidtrade.biz", To: []string{"shaun@rapidtrade.biz"}, ReplyTo: []string{"not an address"}}},
+	}
+	for _, tt := range tests {
+		if b, err := tt.e.Bytes(); err == nil {
+			t.Errorf("%s: expected an error, got %q", tt.name, b)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package amazon
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Object describes an object, or a common prefix when listing with a delimiter.
+// Listing fills in the first fields, S3Stat fills in all of them.
+type S3Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	StorageClass string
+	IsPrefix     bool // a "folder" grouped by the delimiter, only Key is set
+
+	ContentType     string
+	ContentEncoding string
+	Metadata        map[string]string
+	VersionID       string
+}
+
+// S3ListOptions are the optional settings for S3List
+type S3ListOptions struct {
+	Prefix     string
+	Delimiter  string // eg. / to list one level of "folders" as prefixes
+	StartAfter string // only keys after this one
+	PageSize   int64  // keys fetched at a time, 1000 if 0
+}
+
+// S3ListIterator pages through a listing, fetching the next page as the last one is used up, eg.
+//
+//	it := amazon.S3List(cfg, "rapidtradeinbox", &amazon.S3ListOptions{Prefix: "orders/", Delimiter: "/"})
+//	for it.Next() {
+//		o := it.Object()
+//	}
+//	if err := it.Err(); err != nil {
+type S3ListIterator struct {
+	svc   *s3.S3
+	input *s3.ListObjectsV2Input
+	err   error
+	page  []*S3Object
+	cur   *S3Object
+	done  bool
+}
+
+// S3List lists a bucket, a nil *S3ListOptions lists every key
+func S3List(cfg *Config, bucket string, opts *S3ListOptions) *S3ListIterator {
+	if opts == nil {
+		opts = &S3ListOptions{}
+	}
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+	if opts.Prefix != "" {
+		input.Prefix = aws.String(opts.Prefix)
+	}
+	if opts.Delimiter != "" {
+		input.Delimiter = aws.String(opts.Delimiter)
+	}
+	if opts.StartAfter != "" {
+		input.StartAfter = aws.String(opts.StartAfter)
+	}
+	if opts.PageSize > 0 {
+		input.MaxKeys = aws.Int64(opts.PageSize)
+	}
+	svc, err := s3Service(cfg)
+	return &S3ListIterator{svc: svc, input: input, err: err}
+}
+
+// Next moves to the next object, it returns false at the end or on an error
+func (it *S3ListIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || it.done {
+			return false
+		}
+		it.fetch()
+	}
+	it.cur, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Object is the current object
+func (it *S3ListIterator) Object() *S3Object {
+	return it.cur
+}
+
+// Err is the error that stopped Next, if any
+func (it *S3ListIterator) Err() error {
+	return it.err
+}
+
+// fetch gets the next page, putting the prefixes in key order among the objects
+func (it *S3ListIterator) fetch() {
+	out, err := it.svc.ListObjectsV2(it.input)
+	if err != nil {
+		it.err = err
+		return
+	}
+	for _, o := range out.Contents {
+		it.page = append(it.page, &S3Object{
+			Key:          aws.StringValue(o.Key),
+			Size:         aws.Int64Value(o.Size),
+			ETag:         aws.StringValue(o.ETag),
+			LastModified: aws.TimeValue(o.LastModified),
+			StorageClass: aws.StringValue(o.StorageClass),
+		})
+	}
+	for _, p := range out.CommonPrefixes {
+		it.page = append(it.page, &S3Object{Key: aws.StringValue(p.Prefix), IsPrefix: true})
+	}
+	sort.Slice(it.page, func(i, j int) bool { return it.page[i].Key < it.page[j].Key })
+	if aws.BoolValue(out.IsTruncated) && out.NextContinuationToken != nil {
+		it.input.ContinuationToken = out.NextContinuationToken
+	} else {
+		it.done = true
+	}
+}
+
+// S3ListBucket lists the keys under a prefix, returning a slice like gcloud.ListBucketGS
+func S3ListBucket(cfg *Config, bucket string, prefix string) ([]string, error) {
+	var keys []string
+	it := S3List(cfg, bucket, &S3ListOptions{Prefix: prefix})
+	for it.Next() {
+		keys = append(keys, it.Object().Key)
+	}
+	return keys, it.Err()
+}
+
+// S3Stat returns the size, type and metadata of an object without downloading it, use IsS3NotFound to check the error
+func S3Stat(cfg *Config, bucket string, key string) (*S3Object, error) {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Object{
+		Key:             key,
+		Size:            aws.Int64Value(out.ContentLength),
+		ETag:            aws.StringValue(out.ETag),
+		LastModified:    aws.TimeValue(out.LastModified),
+		StorageClass:    aws.StringValue(out.StorageClass),
+		ContentType:     aws.StringValue(out.ContentType),
+		ContentEncoding: aws.StringValue(out.ContentEncoding),
+		Metadata:        aws.StringValueMap(out.Metadata),
+		VersionID:       aws.StringValue(out.VersionId),
+	}, nil
+}
+
+// S3Exists checks if an object exists
+func S3Exists(cfg *Config, bucket string, key string) (bool, error) {
+	_, err := S3Stat(cfg, bucket, key)
+	if IsS3NotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsS3NotFound checks if an error is because the object or bucket does not exist
+func IsS3NotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
+
+// s3MaxCopySize is the largest object CopyObject can copy in one go, bigger ones are copied in parts
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// s3CopyPartSize is the size of each part when copying in parts
+const s3CopyPartSize = 512 * 1024 * 1024
+
+// S3Copy copies an object within S3 without downloading it, keeping its metadata and tags, like gcloud.CopyGS
+func S3Copy(cfg *Config, srcBucket string, srcKey string, destBucket string, destKey string) error {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return err
+	}
+	src, err := S3Stat(cfg, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	source := copySource(srcBucket, srcKey)
+	if src.Size <= s3MaxCopySize {
+		_, err = svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(destBucket),
+			Key:        aws.String(destKey),
+			CopySource: aws.String(source),
+		})
+		return err
+	}
+	return s3CopyParts(svc, srcBucket, src, source, destBucket, destKey)
+}
+
+// s3CopyParts copies an object bigger than 5GB as a multipart upload, each part copied from the source
+func s3CopyParts(svc *s3.S3, srcBucket string, src *S3Object, source string, destBucket string, destKey string) error {
+	tags, err := svc.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(src.Key),
+	})
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(destBucket),
+		Key:      aws.String(destKey),
+		Metadata: aws.StringMap(src.Metadata),
+	}
+	if src.ContentType != "" {
+		create.ContentType = aws.String(src.ContentType)
+	}
+	if src.ContentEncoding != "" {
+		create.ContentEncoding = aws.String(src.ContentEncoding)
+	}
+	if err == nil && len(tags.TagSet) > 0 {
+		create.Tagging = aws.String(encodeTags(tagMap(tags.TagSet)))
+	}
+	upload, err := svc.CreateMultipartUpload(create)
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	for start, n := int64(0), int64(1); start < src.Size; start, n = start+s3CopyPartSize, n+1 {
+		end := start + s3CopyPartSize - 1
+		if end >= src.Size {
+			end = src.Size - 1
+		}
+		out, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(destBucket),
+			Key:             aws.String(destKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(destBucket),
+				Key:      aws.String(destKey),
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(destBucket),
+		Key:             aws.String(destKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// copySource is the bucket and URL encoded key CopyObject expects
+func copySource(bucket string, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
+
+// S3Move copies an object and then deletes the source, eg. from the inbox to an archive once processed
+func S3Move(cfg *Config, srcBucket string, srcKey string, destBucket string, destKey string) error {
+	if err := S3Copy(cfg, srcBucket, srcKey, destBucket, destKey); err != nil {
+		return err
+	}
+	return S3Delete(cfg, srcBucket, srcKey)
+}
+
+// S3Delete deletes an object, like gcloud.DeleteGS. Deleting a key that does not exist is not an error.
+func S3Delete(cfg *Config, bucket string, key string) error {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// S3DeleteObjects deletes any number of keys, 1000 at a time
+func S3DeleteObjects(cfg *Config, bucket string, keys []string) error {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = s3DeleteKeys(svc, bucket, keys)
+	return err
+}
+
+// S3DeletePrefix deletes every object under a prefix, eg. a whole "folder". An empty prefix is an error rather
+// than emptying the bucket.
+func S3DeletePrefix(cfg *Config, bucket string, prefix string) error {
+	if prefix == "" {
+		return errors.New("S3DeletePrefix needs a prefix, it will not delete a whole bucket")
+	}
+	keys, err := S3ListBucket(cfg, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	return S3DeleteObjects(cfg, bucket, keys)
+}
+
+// s3DeleteKeys deletes keys in batches of 1000, the most DeleteObjects takes. It carries on past keys that fail,
+// returning why each key failed and an error naming the first. If a batch fails, it and the rest are not tried.
+func s3DeleteKeys(svc *s3.S3, bucket string, keys []string) (map[string]string, error) {
+	failed := make(map[string]string)
+	var first string
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, key := range keys[start:] {
+				failed[key] = err.Error()
+			}
+			return failed, err
+		}
+		for _, e := range out.Errors {
+			if first == "" {
+				first = aws.StringValue(e.Key)
+			}
+			failed[aws.StringValue(e.Key)] = aws.StringValue(e.Message)
+		}
+	}
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("unable to delete %d of %d keys, %s: %s", len(failed), len(keys), first, failed[first])
+	}
+	return nil, nil
+}
+
+// S3GetTags returns the tags of an object
+func S3GetTags(cfg *Config, bucket string, key string) (map[string]string, error) {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tagMap(out.TagSet), nil
+}
+
+// S3PutTags replaces the tags of an object, at most 10
+func S3PutTags(cfg *Config, bucket string, key string, tags map[string]string) error {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return err
+	}
+	var tagSet []*s3.Tag
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err = svc.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+func tagMap(tagSet []*s3.Tag) map[string]string {
+	tags := make(map[string]string, len(tagSet))
+	for _, t := range tagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags
+}
@@ -0,0 +1,192 @@
+package amazon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3PresignOptions are the optional constraints on a presigned PUT, a nil *S3PresignOptions allows any upload
+type S3PresignOptions struct {
+	ContentType string            // the Content-Type the upload must have
+	ContentMD5  string            // the base64 MD5 the upload must have, so only that exact file can be uploaded
+	Metadata    map[string]string // x-amz-meta- headers the upload must have
+	SSE         string            // AES256 or aws:kms, the upload must ask for this encryption
+}
+
+// S3PresignGet returns a URL anyone can download the object from until it expires, at most 7 days
+func S3PresignGet(cfg *Config, bucket string, key string, expires time.Duration) (string, error) {
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return "", err
+	}
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expires)
+}
+
+// S3PresignPut returns a URL anyone can upload the object to until it expires, eg. for a supplier to drop
+// a file into the inbox. The headers returned are signed into the URL, the upload must send them as they are:
+//
+//	url, headers, err := amazon.S3PresignPut(cfg, "rapidtradeinbox", "orders/"+name, time.Hour, &amazon.S3PresignOptions{
+//		ContentType: "text/csv",
+//	})
+func S3PresignPut(cfg *Config, bucket string, key string, expires time.Duration, opts *S3PresignOptions) (string, http.Header, error) {
+	if opts == nil {
+		opts = &S3PresignOptions{}
+	}
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.ContentMD5 != "" {
+		input.ContentMD5 = aws.String(opts.ContentMD5)
+	}
+	if len(opts.Metadata) > 0 {
+		input.Metadata = aws.StringMap(opts.Metadata)
+	}
+	if opts.SSE != "" {
+		input.ServerSideEncryption = aws.String(opts.SSE)
+	}
+	req, _ := svc.PutObjectRequest(input)
+	return req.PresignRequest(expires)
+}
+
+// S3PostPolicy sets what a browser form, or any multipart POST, may upload
+type S3PostPolicy struct {
+	Key         string // the exact key, or
+	KeyPrefix   string // any key starting with this, the form sets it in its key field
+	ContentType string // the exact Content-Type, or if it ends in /, any type starting with it, eg. image/
+	MinSize     int64
+	MaxSize     int64             // no limit if 0
+	Metadata    map[string]string // x-amz-meta- fields the form must send
+	Fields      map[string]string // any other fields the form must send as they are, eg. acl or success_action_status
+	Expires     time.Duration     // 1 hour if 0
+}
+
+// S3PresignedPost is the form to POST to URL, send Fields as form fields followed by the file as the last field
+type S3PresignedPost struct {
+	URL    string
+	Fields map[string]string
+}
+
+// S3PresignPost signs a POST policy, the way for a browser to upload straight to S3, eg.
+//
+//	post, err := amazon.S3PresignPost(cfg, "rapidtradeinbox", &amazon.S3PostPolicy{
+//		KeyPrefix: "suppliers/" + supplierID + "/",
+//		MaxSize:   50 << 20,
+//	})
+func S3PresignPost(cfg *Config, bucket string, p *S3PostPolicy) (*S3PresignedPost, error) {
+	if p.Key == "" && p.KeyPrefix == "" {
+		return nil, errors.New("post policy needs a Key or KeyPrefix")
+	}
+	sess, err := cfg.Session()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(sess)
+
+	// the bucket URL, with the custom endpoint and path style if set
+	req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err = req.Build(); err != nil {
+		return nil, err
+	}
+	u := *req.HTTPRequest.URL
+	u.RawQuery = ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	expires := p.Expires
+	if expires == 0 {
+		expires = time.Hour
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	credential := creds.AccessKeyID + "/" + date + "/" + cfg.GetRegion() + "/s3/aws4_request"
+
+	fields := map[string]string{
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": credential,
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	for k, v := range p.Fields {
+		fields[k] = v
+	}
+	for k, v := range p.Metadata {
+		fields["x-amz-meta-"+k] = v
+	}
+
+	conditions := []interface{}{map[string]string{"bucket": bucket}}
+	for k, v := range fields {
+		conditions = append(conditions, map[string]string{k: v})
+	}
+	if p.Key != "" {
+		fields["key"] = p.Key
+		conditions = append(conditions, map[string]string{"key": p.Key})
+	} else {
+		fields["key"] = p.KeyPrefix + "${filename}"
+		conditions = append(conditions, []string{"starts-with", "$key", p.KeyPrefix})
+	}
+	if p.ContentType != "" {
+		if strings.HasSuffix(p.ContentType, "/") {
+			conditions = append(conditions, []string{"starts-with", "$Content-Type", p.ContentType})
+		} else {
+			fields["Content-Type"] = p.ContentType
+			conditions = append(conditions, map[string]string{"Content-Type": p.ContentType})
+		}
+	}
+	if p.MaxSize > 0 {
+		conditions = append(conditions, []interface{}{"content-length-range", p.MinSize, p.MaxSize})
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(expires).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey(creds.SecretAccessKey, date, cfg.GetRegion(), "s3"), fields["policy"]))
+	return &S3PresignedPost{URL: u.String(), Fields: fields}, nil
+}
+
+// signingKey derives the signature version 4 key for a day, region and service
+func signingKey(secret string, date string, region string, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,359 @@
+package amazon
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3UploadOptions are the optional settings for S3Upload, a nil *S3UploadOptions uploads with the defaults
+type S3UploadOptions struct {
+	ContentType     string // worked out from the key extension, or else the content, if empty
+	ContentEncoding string // eg. gzip
+	CacheControl    string
+	Metadata        map[string]string
+	Tags            map[string]string
+	StorageClass    string // eg. STANDARD_IA or GLACIER, STANDARD if empty
+	SSE             string // AES256 for SSE-S3 or aws:kms for SSE-KMS
+	KMSKeyID        string // the KMS key for aws:kms, the account default if empty
+
+	PartSize    int64 // bytes in each part of a multipart upload, 5MB if 0
+	Concurrency int   // parts uploaded at once, 5 if 0
+	// Progress is called as each part is uploaded, total is -1 if the size is not known
+	Progress func(sent int64, total int64)
+}
+
+// S3UploadResult is what S3 returns for an upload
+type S3UploadResult struct {
+	Location  string
+	ETag      string
+	VersionID string // only set if the bucket is versioned
+}
+
+// S3Upload uploads from a reader, eg.
+//
+//	res, err := amazon.S3Upload(cfg, "rapidtradeinbox", "orders/"+name, f, &amazon.S3UploadOptions{
+//		SSE:      "aws:kms",
+//		Tags:     map[string]string{"supplier": supplierID},
+//		Progress: func(sent, total int64) { Info.Printf("%d of %d", sent, total) },
+//	})
+func S3Upload(cfg *Config, bucket string, key string, body io.Reader, opts *S3UploadOptions) (*S3UploadResult, error) {
+	if opts == nil {
+		opts = &S3UploadOptions{}
+	}
+	sess, err := cfg.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType, body, err = detectContentType(key, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}
+	if opts.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(opts.ContentEncoding)
+	}
+	if opts.CacheControl != "" {
+		input.CacheControl = aws.String(opts.CacheControl)
+	}
+	if len(opts.Metadata) > 0 {
+		input.Metadata = aws.StringMap(opts.Metadata)
+	}
+	if len(opts.Tags) > 0 {
+		input.Tagging = aws.String(encodeTags(opts.Tags))
+	}
+	if opts.StorageClass != "" {
+		input.StorageClass = aws.String(opts.StorageClass)
+	}
+	if opts.SSE != "" {
+		input.ServerSideEncryption = aws.String(opts.SSE)
+	}
+	if opts.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(opts.KMSKeyID)
+	}
+
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		if opts.PartSize > 0 {
+			u.PartSize = opts.PartSize
+		}
+		if opts.Concurrency > 0 {
+			u.Concurrency = opts.Concurrency
+		}
+	})
+	var options []func(*s3manager.Uploader)
+	if opts.Progress != nil {
+		options = append(options, s3manager.WithUploaderRequestOptions(uploadProgress(body, opts.Progress)))
+	}
+	out, err := uploader.Upload(input, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &S3UploadResult{
+		Location:  out.Location,
+		ETag:      aws.StringValue(out.ETag),
+		VersionID: aws.StringValue(out.VersionID),
+	}, nil
+}
+
+// S3UploadFile uploads a local file, the parts are read straight from the file
+func S3UploadFile(cfg *Config, bucket string, key string, fileName string, opts *S3UploadOptions) (*S3UploadResult, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return S3Upload(cfg, bucket, key, f, opts)
+}
+
+// detectContentType works out the content type from the key extension, or else the first 512 bytes of the body.
+// The body returned replaces the one passed in, as the bytes sniffed may have been read from it.
+func detectContentType(key string, body io.Reader) (string, io.Reader, error) {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType, body, nil
+	}
+	head := make([]byte, 512)
+	if ra, ok := body.(io.ReaderAt); ok {
+		if _, seekable := body.(io.Seeker); seekable {
+			n, err := ra.ReadAt(head, 0)
+			if err != nil && err != io.EOF {
+				return "", nil, err
+			}
+			return http.DetectContentType(head[:n]), body, nil
+		}
+	}
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), body), nil
+}
+
+// encodeTags encodes tags as the URL query S3 expects, eg. supplier=1234&type=orders
+func encodeTags(tags map[string]string) string {
+	v := url.Values{}
+	for k, tag := range tags {
+		v.Set(k, tag)
+	}
+	return v.Encode()
+}
+
+// uploadProgress adds the size of each part, or the whole object, to the count once S3 has accepted it
+func uploadProgress(body io.Reader, progress func(sent int64, total int64)) request.Option {
+	total := int64(-1)
+	if s, ok := body.(io.Seeker); ok {
+		if cur, err := s.Seek(0, io.SeekCurrent); err == nil {
+			if end, err := s.Seek(0, io.SeekEnd); err == nil {
+				total = end - cur
+			}
+			s.Seek(cur, io.SeekStart)
+		}
+	}
+	var sent int64
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error != nil || r.HTTPRequest == nil {
+				return
+			}
+			switch r.Operation.Name {
+			case "PutObject", "UploadPart":
+				progress(atomic.AddInt64(&sent, r.HTTPRequest.ContentLength), total)
+			}
+		})
+	}
+}
+
+// S3DownloadOptions are the optional settings for the S3 downloads, a nil *S3DownloadOptions downloads the whole object
+type S3DownloadOptions struct {
+	Range           string    // eg. bytes=0-1023, the whole object if empty
+	VersionID       string    // the latest version if empty
+	IfNoneMatch     string    // only download if the ETag has changed
+	IfModifiedSince time.Time // only download if modified since
+
+	PartSize    int64 // bytes in each part downloaded, 5MB if 0
+	Concurrency int   // parts downloaded at once, 5 if 0
+}
+
+// S3DownloadResult describes what was downloaded
+type S3DownloadResult struct {
+	Bytes        int64
+	ETag         string
+	VersionID    string
+	LastModified time.Time
+	NotModified  bool // nothing was downloaded as IfNoneMatch or IfModifiedSince did not match
+}
+
+func (opts *S3DownloadOptions) getObjectInput(bucket string, key string) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if opts.Range != "" {
+		input.Range = aws.String(opts.Range)
+	}
+	if opts.VersionID != "" {
+		input.VersionId = aws.String(opts.VersionID)
+	}
+	if opts.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(opts.IfNoneMatch)
+	}
+	if !opts.IfModifiedSince.IsZero() {
+		input.IfModifiedSince = aws.Time(opts.IfModifiedSince)
+	}
+	return input
+}
+
+// isNotModified checks for the 304 S3 returns when a conditional download did not match
+func isNotModified(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotModified
+	}
+	return false
+}
+
+// S3DownloadTo downloads into w, fetching parts concurrently, eg. into an os.File or aws.WriteAtBuffer
+func S3DownloadTo(cfg *Config, bucket string, key string, w io.WriterAt, opts *S3DownloadOptions) (*S3DownloadResult, error) {
+	if opts == nil {
+		opts = &S3DownloadOptions{}
+	}
+	sess, err := cfg.Session()
+	if err != nil {
+		return nil, err
+	}
+	downloader := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) {
+		if opts.PartSize > 0 {
+			d.PartSize = opts.PartSize
+		}
+		if opts.Concurrency > 0 {
+			d.Concurrency = opts.Concurrency
+		}
+	})
+
+	// the downloader only returns the size, so pick the rest up off the first part
+	result := &S3DownloadResult{}
+	var once sync.Once
+	capture := func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if out, ok := r.Data.(*s3.GetObjectOutput); ok && r.Error == nil {
+				once.Do(func() {
+					result.ETag = aws.StringValue(out.ETag)
+					result.VersionID = aws.StringValue(out.VersionId)
+					result.LastModified = aws.TimeValue(out.LastModified)
+				})
+			}
+		})
+	}
+
+	result.Bytes, err = downloader.Download(w, opts.getObjectInput(bucket, key), s3manager.WithDownloaderRequestOptions(capture))
+	if isNotModified(err) {
+		return &S3DownloadResult{NotModified: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// S3DownloadStream downloads into any io.Writer as a single stream, use S3DownloadTo for concurrent parts
+func S3DownloadStream(cfg *Config, bucket string, key string, w io.Writer, opts *S3DownloadOptions) (*S3DownloadResult, error) {
+	if opts == nil {
+		opts = &S3DownloadOptions{}
+	}
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetObject(opts.getObjectInput(bucket, key))
+	if isNotModified(err) {
+		return &S3DownloadResult{NotModified: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	n, err := io.Copy(w, out.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &S3DownloadResult{
+		Bytes:        n,
+		ETag:         aws.StringValue(out.ETag),
+		VersionID:    aws.StringValue(out.VersionId),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// S3DownloadFile downloads to fileName, creating its folder if needed. It downloads to a temp file alongside
+// and renames it once complete, so fileName is never left half written. If NotModified the file is left as it was.
+func S3DownloadFile(cfg *Config, bucket string, key string, fileName string, opts *S3DownloadOptions) (*S3DownloadResult, error) {
+	dir := filepath.Dir(fileName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := createTemp(dir, "."+filepath.Base(fileName)+".")
+	if err != nil {
+		return nil, err
+	}
+	result, err := S3DownloadTo(cfg, bucket, key, tmp, opts)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || result.NotModified {
+		os.Remove(tmp.Name())
+		return result, err
+	}
+	if err = os.Rename(tmp.Name(), fileName); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if !result.LastModified.IsZero() {
+		os.Chtimes(fileName, result.LastModified, result.LastModified)
+	}
+	return result, nil
+}
+
+// createTemp is ioutil.TempFile, but creates the file 0666 less the umask like os.Create, rather than 0600,
+// so the renamed download can be read by other processes as before
+func createTemp(dir string, prefix string) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatInt(time.Now().UnixNano()+int64(i), 36))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// s3Service returns an S3 client for the config
+func s3Service(cfg *Config) (*s3.S3, error) {
+	sess, err := cfg.Session()
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
@@ -0,0 +1,487 @@
+package amazon
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3SyncOptions are the optional settings for S3SyncUp and S3SyncDown
+type S3SyncOptions struct {
+	// Include and Exclude are globs matched against the path relative to the folder or prefix, using / on
+	// all platforms, or against the file name, eg. "*.csv" or "orders/*". Everything is included if Include is empty.
+	Include []string
+	Exclude []string
+
+	Delete   bool // delete files at the destination that are not at the source
+	DryRun   bool // only report what would be done
+	Parallel int  // transfers at once, 4 if 0
+
+	Upload *S3UploadOptions // settings for the files uploaded by S3SyncUp, an md5 is added to the Metadata
+}
+
+// S3SyncAction is one transfer or delete done, or to be done if DryRun
+type S3SyncAction struct {
+	Action string // upload, download or delete
+	Path   string // relative to the folder and prefix
+	Size   int64
+	Reason string // new, size, changed or extraneous
+	Err    error
+}
+
+// S3SyncReport lists what a sync did, or would do if DryRun
+type S3SyncReport struct {
+	Actions   []*S3SyncAction
+	Unchanged int
+}
+
+func (r *S3SyncReport) String() string {
+	var b bytes.Buffer
+	for _, a := range r.Actions {
+		fmt.Fprintf(&b, "%-8s %-10s %12d %s", a.Action, a.Reason, a.Size, a.Path)
+		if a.Err != nil {
+			fmt.Fprintf(&b, " error: %v", a.Err)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%d to transfer or delete, %d unchanged\n", len(r.Actions), r.Unchanged)
+	return b.String()
+}
+
+// syncFile is a file or object on either side
+type syncFile struct {
+	size int64
+	etag string // objects only
+	key  string // objects only
+	path string // local files only
+}
+
+// syncMD5Metadata is the metadata S3SyncUp stores the MD5 of each file in, for objects whose ETag is not an MD5,
+// eg. ones encrypted with SSE-KMS
+const syncMD5Metadata = "md5"
+
+// S3SyncUp uploads the files in folder that are new or changed to the bucket under prefix.
+// folder must exist, and Delete needs a prefix, so a mistyped path cannot empty the bucket.
+func S3SyncUp(cfg *Config, folder string, bucket string, prefix string, opts *S3SyncOptions) (*S3SyncReport, error) {
+	if opts == nil {
+		opts = &S3SyncOptions{}
+	}
+	if info, err := os.Stat(folder); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", folder)
+	}
+	if opts.Delete && prefix == "" {
+		return nil, errors.New("S3SyncUp needs a prefix to Delete, it will not delete from a whole bucket")
+	}
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return nil, err
+	}
+	prefix = syncPrefix(prefix)
+	local, err := listLocal(folder, opts)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := listRemote(svc, bucket, prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &S3SyncReport{}
+	for _, rel := range sortedKeys(local) {
+		l := local[rel]
+		reason, err := syncReason(svc, bucket, l, remote[rel], opts)
+		if err != nil {
+			return nil, err
+		}
+		if reason == "" {
+			report.Unchanged++
+			continue
+		}
+		report.Actions = append(report.Actions, &S3SyncAction{Action: "upload", Path: rel, Size: l.size, Reason: reason})
+	}
+	var deletes []string
+	if opts.Delete {
+		for _, rel := range sortedKeys(remote) {
+			if _, ok := local[rel]; !ok {
+				report.Actions = append(report.Actions, &S3SyncAction{Action: "delete", Path: rel, Size: remote[rel].size, Reason: "extraneous"})
+				deletes = append(deletes, prefix+rel)
+			}
+		}
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	err = runSync(report, opts, func(a *S3SyncAction) error {
+		switch a.Action {
+		case "upload":
+			return syncUpload(cfg, bucket, prefix+a.Path, local[a.Path], opts)
+		}
+		return nil
+	})
+	if len(deletes) > 0 {
+		failed, derr := s3DeleteKeys(svc, bucket, deletes)
+		for _, a := range report.Actions {
+			if msg, ok := failed[prefix+a.Path]; ok && a.Action == "delete" {
+				a.Err = errors.New(msg)
+			}
+		}
+		if derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return report, err
+}
+
+// S3SyncDown downloads the objects under prefix that are new or changed to folder.
+// With Delete set it fails if there are no objects under prefix, rather than delete every local file.
+func S3SyncDown(cfg *Config, bucket string, prefix string, folder string, opts *S3SyncOptions) (*S3SyncReport, error) {
+	if opts == nil {
+		opts = &S3SyncOptions{}
+	}
+	svc, err := s3Service(cfg)
+	if err != nil {
+		return nil, err
+	}
+	prefix = syncPrefix(prefix)
+	remote, err := listRemote(svc, bucket, prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Delete && len(remote) == 0 {
+		return nil, fmt.Errorf("nothing under s3://%s/%s, it will not Delete every file in %s", bucket, prefix, folder)
+	}
+	local, err := listLocal(folder, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &S3SyncReport{}
+	for _, rel := range sortedKeys(remote) {
+		r := remote[rel]
+		if _, err := syncLocalPath(folder, rel); err != nil {
+			report.Actions = append(report.Actions, &S3SyncAction{Action: "download", Path: rel, Size: r.size, Reason: "unsafe", Err: err})
+			continue
+		}
+		l, ok := local[rel]
+		var reason string
+		if !ok {
+			reason = "new"
+		} else if reason, err = syncReason(svc, bucket, l, r, opts); err != nil {
+			return nil, err
+		}
+		if reason == "" {
+			report.Unchanged++
+			continue
+		}
+		report.Actions = append(report.Actions, &S3SyncAction{Action: "download", Path: rel, Size: r.size, Reason: reason})
+	}
+	if opts.Delete {
+		for _, rel := range sortedKeys(local) {
+			if _, ok := remote[rel]; !ok {
+				report.Actions = append(report.Actions, &S3SyncAction{Action: "delete", Path: rel, Size: local[rel].size, Reason: "extraneous"})
+			}
+		}
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+
+	err = runSync(report, opts, func(a *S3SyncAction) error {
+		switch a.Action {
+		case "download":
+			fileName, err := syncLocalPath(folder, a.Path)
+			if err != nil {
+				return err
+			}
+			_, err = S3DownloadFile(cfg, bucket, prefix+a.Path, fileName, nil)
+			return err
+		case "delete":
+			return os.Remove(local[a.Path].path)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// syncLocalPath is where an object goes under folder. Keys such as orders/../../etc/passwd are rejected,
+// as anyone allowed to upload under the prefix, eg. through S3PresignPost, could otherwise write anywhere.
+func syncLocalPath(folder string, rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if filepath.IsAbs(local) || filepath.VolumeName(local) != "" {
+		return "", fmt.Errorf("unsafe key %s", rel)
+	}
+	fileName := filepath.Join(folder, local)
+	r, err := filepath.Rel(filepath.Clean(folder), fileName)
+	if err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unsafe key %s, it is outside %s", rel, folder)
+	}
+	return fileName, nil
+}
+
+// syncUpload uploads a file with its MD5 in the metadata, so it can be compared later whatever its ETag
+func syncUpload(cfg *Config, bucket string, key string, local *syncFile, opts *S3SyncOptions) error {
+	sum, err := localMD5(local)
+	if err != nil {
+		return err
+	}
+	upload := S3UploadOptions{}
+	if opts.Upload != nil {
+		upload = *opts.Upload
+	}
+	upload.Metadata = map[string]string{syncMD5Metadata: sum}
+	if opts.Upload != nil {
+		for k, v := range opts.Upload.Metadata {
+			upload.Metadata[k] = v
+		}
+	}
+	_, err = S3UploadFile(cfg, bucket, key, local.path, &upload)
+	return err
+}
+
+// syncReason says why a local file and object differ, or returns "" if they are the same. If the ETag does not
+// match, which it never does for SSE-KMS objects, the MD5 S3SyncUp stored in the metadata is checked instead.
+func syncReason(svc *s3.S3, bucket string, local *syncFile, remote *syncFile, opts *S3SyncOptions) (string, error) {
+	if remote == nil {
+		return "new", nil
+	}
+	if local.size != remote.size {
+		return "size", nil
+	}
+	same, err := etagMatches(local.path, local.size, remote.etag, opts)
+	if err != nil || same {
+		return "", err
+	}
+	out, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(remote.key),
+	})
+	if err != nil {
+		return "", err
+	}
+	for k, v := range out.Metadata {
+		if strings.EqualFold(k, syncMD5Metadata) {
+			sum, err := localMD5(local)
+			if err != nil {
+				return "", err
+			}
+			if sum == aws.StringValue(v) {
+				return "", nil
+			}
+		}
+	}
+	return "changed", nil
+}
+
+// localMD5 is the hex MD5 of a whole local file
+func localMD5(local *syncFile) (string, error) {
+	if local.size == 0 {
+		return emptyMD5, nil
+	}
+	sums, err := fileMD5(local.path, local.size)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sums[0]), nil
+}
+
+// etagMatches checks a local file against an ETag. A plain ETag is the MD5 of the object, a multipart one
+// ending in -N is the MD5 of the N part MD5s, so we try the part sizes it was likely uploaded with.
+func etagMatches(fileName string, size int64, etag string, opts *S3SyncOptions) (bool, error) {
+	etag = strings.Trim(etag, `"`)
+	if size == 0 {
+		return etag == emptyMD5, nil
+	}
+	i := strings.Index(etag, "-")
+	if i < 0 {
+		sum, err := fileMD5(fileName, size)
+		if err != nil {
+			return false, err
+		}
+		return hex.EncodeToString(sum[0]) == etag, nil
+	}
+	parts, err := strconv.ParseInt(etag[i+1:], 10, 64)
+	if err != nil || parts < 1 {
+		return false, nil
+	}
+	const mb = 1024 * 1024
+	candidates := []int64{5 * mb, 8 * mb, 16 * mb}
+	if opts.Upload != nil && opts.Upload.PartSize > 0 {
+		candidates = append([]int64{opts.Upload.PartSize}, candidates...)
+	}
+	// the part size rounded up to the next MB, as most tools use whole MBs
+	candidates = append(candidates, ((size+parts-1)/parts+mb-1)/mb*mb)
+	for _, partSize := range candidates {
+		if (size+partSize-1)/partSize != parts {
+			continue
+		}
+		sums, err := fileMD5(fileName, partSize)
+		if err != nil {
+			return false, err
+		}
+		h := md5.New()
+		for _, sum := range sums {
+			h.Write(sum)
+		}
+		if hex.EncodeToString(h.Sum(nil))+"-"+strconv.FormatInt(parts, 10) == etag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// emptyMD5 is the MD5, and so the ETag, of an empty object
+const emptyMD5 = "d41d8cd98f00b204e9800998ecf8427e"
+
+// fileMD5 returns the MD5 of each partSize bytes of a file, an empty file has one part
+func fileMD5(fileName string, partSize int64) ([][]byte, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("invalid part size %d", partSize)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var sums [][]byte
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, partSize)
+		if n > 0 || len(sums) == 0 {
+			sums = append(sums, h.Sum(nil))
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n < partSize {
+			return sums, nil
+		}
+	}
+}
+
+// runSync runs the actions in parallel, recording any error on the action and returning the first.
+// Actions that already have an error, eg. an unsafe key, are not run.
+func runSync(report *S3SyncReport, opts *S3SyncOptions, do func(a *S3SyncAction) error) error {
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = 4
+	}
+	actions := make(chan *S3SyncAction)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range actions {
+				if a.Err == nil {
+					a.Err = do(a)
+				}
+			}
+		}()
+	}
+	for _, a := range report.Actions {
+		actions <- a
+	}
+	close(actions)
+	wg.Wait()
+	for _, a := range report.Actions {
+		if a.Err != nil {
+			return fmt.Errorf("%s %s: %v", a.Action, a.Path, a.Err)
+		}
+	}
+	return nil
+}
+
+// syncPrefix makes sure a prefix ends in /, so "inbox" does not also match "inbox2/"
+func syncPrefix(prefix string) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		return prefix + "/"
+	}
+	return prefix
+}
+
+// syncIncluded checks a relative path against the include and exclude globs
+func syncIncluded(rel string, opts *S3SyncOptions) bool {
+	match := func(globs []string) bool {
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(glob, path.Base(rel)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(opts.Include) > 0 && !match(opts.Include) {
+		return false
+	}
+	return !match(opts.Exclude)
+}
+
+// listLocal lists the files under folder by their slash separated relative path, none if folder does not exist
+func listLocal(folder string, opts *S3SyncOptions) (map[string]*syncFile, error) {
+	files := make(map[string]*syncFile)
+	if _, err := os.Stat(folder); os.IsNotExist(err) {
+		return files, nil
+	}
+	err := filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(folder, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if syncIncluded(rel, opts) {
+			files[rel] = &syncFile{size: info.Size(), path: p}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// listRemote lists the objects under prefix by their path relative to it
+func listRemote(svc *s3.S3, bucket string, prefix string, opts *S3SyncOptions) (map[string]*syncFile, error) {
+	objects := make(map[string]*syncFile)
+	it := &S3ListIterator{svc: svc, input: &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}}
+	for it.Next() {
+		o := it.Object()
+		rel := strings.TrimPrefix(o.Key, prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			continue // folder markers
+		}
+		if syncIncluded(rel, opts) {
+			objects[rel] = &syncFile{size: o.Size, etag: o.ETag, key: o.Key}
+		}
+	}
+	return objects, it.Err()
+}
+
+func sortedKeys(m map[string]*syncFile) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
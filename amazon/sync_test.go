@@ -0,0 +1,177 @@
+package amazon
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// multipartETag is the ETag S3 gives an object uploaded in parts of partSize
+func multipartETag(data []byte, partSize int) string {
+	var sums []byte
+	parts := 0
+	for start := 0; start < len(data); start += partSize {
+		end := start + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[start:end])
+		sums = append(sums, sum[:]...)
+		parts++
+	}
+	sum := md5.Sum(sums)
+	return hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(parts)
+}
+
+func TestETagMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hello := []byte("hello world")
+	helloSum := md5.Sum(hello)
+	big := bytes.Repeat([]byte("0123456789"), 300) // 3000 bytes, 3 parts of 1024
+	opts := &S3SyncOptions{Upload: &S3UploadOptions{PartSize: 1024}}
+
+	tests := []struct {
+		name string
+		data []byte
+		etag string
+		opts *S3SyncOptions
+		want bool
+	}{
+		{"empty", nil, `"` + emptyMD5 + `"`, &S3SyncOptions{}, true},
+		{"empty changed", nil, hex.EncodeToString(helloSum[:]), &S3SyncOptions{}, false},
+		{"single part", hello, `"` + hex.EncodeToString(helloSum[:]) + `"`, &S3SyncOptions{}, true},
+		{"single part changed", hello, emptyMD5, &S3SyncOptions{}, false},
+		{"multipart", big, multipartETag(big, 1024), opts, true},
+		{"multipart unknown part size", big, multipartETag(big, 1000), &S3SyncOptions{}, false},
+		{"multipart changed", big, multipartETag(bytes.Repeat([]byte("9876543210"), 300), 1024), opts, false},
+		{"multipart bad count", big, "abc-x", opts, false},
+	}
+	for _, tt := range tests {
+		fileName := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(fileName, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := etagMatches(fileName, int64(len(tt.data)), tt.etag, tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileMD5(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		size     int
+		partSize int64
+		parts    int
+	}{
+		{"empty", 0, 1024, 1},
+		{"empty part size 0", 0, 0, -1},
+		{"smaller than a part", 10, 1024, 1},
+		{"exact parts", 2048, 1024, 2},
+		{"last part short", 2049, 1024, 3},
+	}
+	for _, tt := range tests {
+		fileName := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(fileName, bytes.Repeat([]byte("x"), tt.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sums, err := fileMD5(fileName, tt.partSize)
+		if tt.parts < 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(sums) != tt.parts {
+			t.Errorf("%s: got %d parts, want %d", tt.name, len(sums), tt.parts)
+		}
+	}
+}
+
+func TestSyncLocalPath(t *testing.T) {
+	folder := filepath.Join("data", "inbox")
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{"orders.csv", filepath.Join(folder, "orders.csv")},
+		{"2017/03/orders.csv", filepath.Join(folder, "2017", "03", "orders.csv")},
+		{"2017/../orders.csv", filepath.Join(folder, "orders.csv")},
+		{"..orders.csv", filepath.Join(folder, "..orders.csv")},
+		{"../orders.csv", ""},
+		{"../../etc/x", ""},
+		{"2017/../../inbox2/x", ""},
+		{"/etc/x", ""},
+		{"..", ""},
+		{".", ""},
+	}
+	for _, tt := range tests {
+		got, err := syncLocalPath(folder, tt.rel)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tt.rel, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.rel, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestS3SyncUpRefusesDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		folder string
+		prefix string
+	}{
+		{"missing folder", filepath.Join(dir, "inbx"), "inbox"},
+		{"missing folder whole bucket", filepath.Join(dir, "inbx"), ""},
+		{"whole bucket", dir, ""},
+	}
+	for _, tt := range tests {
+		// these fail before S3 is called, so no config is needed
+		report, err := S3SyncUp(nil, tt.folder, "rapidtradeinbox", tt.prefix, &S3SyncOptions{Delete: true})
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		if report != nil && len(report.Actions) > 0 {
+			t.Errorf("%s: got %d actions, want none", tt.name, len(report.Actions))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// swfhistory exports the history of a workflow execution as a Graphviz DOT graph and/or an HTML timeline.
+//
+// swfhistory -domain rapidtrade -workflowid <id> -runid <runid> -html timeline.html -save history.json
+// swfhistory -file history.json -dot history.dot
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/workflow"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+func main() {
+	domain := flag.String("domain", "", "SWF domain of the workflow")
+	workflowID := flag.String("workflowid", "", "workflow id")
+	runID := flag.String("runid", "", "run id")
+	fileName := flag.String("file", "", "load the history from a JSON file instead of SWF")
+	dot := flag.String("dot", "", "write a DOT graph to this file")
+	html := flag.String("html", "", "write an HTML timeline to this file")
+	save := flag.String("save", "", "save the history as JSON to this file")
+	awsConfig := flag.String("aws", "", "optional JSON file with the AWS config, see amazon.LoadConfig")
+	flag.Parse()
+
+	var events []*swf.HistoryEvent
+	var err error
+	title := *workflowID
+	switch {
+	case *fileName != "":
+		events, err = workflow.LoadHistory(*fileName)
+		title = *fileName
+	case *domain != "" && *workflowID != "" && *runID != "":
+		cfg := &amazon.Config{}
+		if *awsConfig != "" {
+			if cfg, err = amazon.LoadConfig(*awsConfig); err != nil {
+				log.Fatal(err)
+			}
+		}
+		events, err = workflow.GetHistory(cfg, *domain, *workflowID, *runID)
+	default:
+		log.Fatal("Either -file or -domain, -workflowid and -runid are required")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *save != "" {
+		if err = workflow.SaveHistory(*save, events); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *dot != "" {
+		if err = ioutil.WriteFile(*dot, []byte(workflow.HistoryToDOT(events)), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *html != "" {
+		page, err := workflow.HistoryToHTML(title, events)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = ioutil.WriteFile(*html, []byte(page), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
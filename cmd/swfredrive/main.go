@@ -0,0 +1,77 @@
+// swfredrive lists and re-drives failed workflows kept in a dead letter store.
+//
+// swfredrive -folder deadletters -list
+// swfredrive -bucket rapidtradeinbox -prefix deadletters/ -id <id> -fromstep
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/workflow"
+)
+
+func main() {
+	folder := flag.String("folder", "", "local folder holding the dead letters")
+	bucket := flag.String("bucket", "", "S3 bucket holding the dead letters")
+	prefix := flag.String("prefix", "", "S3 prefix of the dead letters")
+	list := flag.Bool("list", false, "list the failed workflows")
+	id := flag.String("id", "", "id of the failed workflow to re-drive")
+	fromStep := flag.Bool("fromstep", false, "re-drive from the failed step rather than from the start")
+	remove := flag.Bool("delete", false, "delete the dead letter once re-driven")
+	awsConfig := flag.String("aws", "", "optional JSON file with the AWS config, see amazon.LoadConfig")
+	flag.Parse()
+
+	cfg := &amazon.Config{}
+	if *awsConfig != "" {
+		var err error
+		if cfg, err = amazon.LoadConfig(*awsConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var store workflow.DeadLetterStore
+	switch {
+	case *folder != "":
+		store = &workflow.FolderDeadLetters{Folder: *folder}
+	case *bucket != "":
+		store = &workflow.S3DeadLetters{Config: cfg, Bucket: *bucket, Prefix: *prefix}
+	default:
+		log.Fatal("Either -folder or -bucket is required")
+	}
+
+	if *list {
+		ids, err := store.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, id := range ids {
+			f, err := store.Get(id)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", f.ID, f.WorkflowType, f.Failed.Format("2006-01-02 15:04:05"), f.FailedActivity, f.Reason)
+		}
+		return
+	}
+
+	if *id == "" {
+		log.Fatal("Either -list or -id is required")
+	}
+	svc, err := amazon.SWFNewSession(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	runid, err := workflow.Redrive(svc, store, *id, *fromStep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Re-driven %s as run %s\n", *id, runid)
+	if *remove {
+		if err = store.Delete(*id); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
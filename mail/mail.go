@@ -0,0 +1,196 @@
+// Package mail sends amazon.Email messages through SES, SMTP or, for tests, a folder of .eml files.
+// Pick the transport in config so local and on-prem deployments need not use SES, eg.
+//
+//	{"transport":"smtp","host":"mail.rapidtrade.biz","port":587,"username":"support","password":"secret"}
+//	{"transport":"file","folder":"/tmp/mail"}
+//	{"transport":"ses","aws":{"region":"eu-west-1"}}
+package mail
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/file"
+)
+
+// Mailer sends an email
+type Mailer interface {
+	Send(e *amazon.Email) error
+}
+
+// Config selects and sets up the transport
+type Config struct {
+	Transport string `json:"transport"` // ses, smtp or file, ses if empty
+
+	// smtp
+	Host     string `json:"host"`
+	Port     int    `json:"port"` // 587 if 0
+	Username string `json:"username"`
+	Password string `json:"password"`
+	NoTLS    bool   `json:"notls"` // skip STARTTLS, only for local test servers
+
+	// file
+	Folder string `json:"folder"`
+
+	// ses
+	AWS *amazon.Config `json:"aws"`
+}
+
+// LoadConfig loads the config from a JSON file, see the package doc for examples
+func LoadConfig(fileName string) (*Config, error) {
+	c := &Config{}
+	if err := file.LoadJSON(fileName, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// New returns the Mailer for the transport in the config
+func New(c *Config) (Mailer, error) {
+	switch c.Transport {
+	case "", "ses":
+		return &SESMailer{Config: c.AWS}, nil
+	case "smtp":
+		if c.Host == "" {
+			return nil, errors.New("smtp mailer needs a host")
+		}
+		return &SMTPMailer{Host: c.Host, Port: c.Port, Username: c.Username, Password: c.Password, NoTLS: c.NoTLS}, nil
+	case "file":
+		if c.Folder == "" {
+			return nil, errors.New("file mailer needs a folder")
+		}
+		return &FileMailer{Folder: c.Folder}, nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %s", c.Transport)
+}
+
+// SESMailer sends through SES. Plain emails to one address go through amazon.SESSendEmail,
+// anything with more recipients, a separate text body or attachments goes through amazon.SESSendRawEmail.
+type SESMailer struct {
+	Config *amazon.Config
+}
+
+// Send sends the email
+func (m *SESMailer) Send(e *amazon.Email) error {
+	simple := len(e.To) == 1 && len(e.CC) == 0 && len(e.BCC) == 0 && len(e.ReplyTo) == 0 &&
+		len(e.Attachments) == 0 && len(e.Inline) == 0 && (e.Text == "" || e.Text == e.HTML)
+	if simple && e.HTML != "" {
+		return amazon.SESSendEmail(m.Config, e.From, e.To[0], e.Subject, e.HTML)
+	}
+	return amazon.SESSendRawEmail(m.Config, e)
+}
+
+// SMTPMailer sends through an SMTP server, using STARTTLS and, if Username is set, PLAIN auth
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	NoTLS    bool
+}
+
+// Send sends the email
+func (m *SMTPMailer) Send(e *amazon.Email) error {
+	data, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	port := m.Port
+	if port == 0 {
+		port = 587
+	}
+	c, err := smtp.Dial(net.JoinHostPort(m.Host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !m.NoTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server " + m.Host + " does not support STARTTLS")
+		}
+		if err = c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	from, err := envelopeAddress(e.From)
+	if err != nil {
+		return err
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, r := range e.Recipients() {
+		to, err := envelopeAddress(r)
+		if err != nil {
+			return err
+		}
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// envelopeAddress strips any name, eg. "Support <support@rapidtrade.biz>" gives support@rapidtrade.biz
+func envelopeAddress(address string) (string, error) {
+	a, err := netmail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid email address %s: %v", address, err)
+	}
+	return a.Address, nil
+}
+
+// FileMailer writes each email to a .eml file in Folder instead of sending it, for tests.
+// An X-Envelope-To header lists all recipients, as BCC is not otherwise in the file.
+type FileMailer struct {
+	Folder string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// Send writes the email
+func (m *FileMailer) Send(e *amazon.Email) error {
+	data, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(m.Folder, 0755); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.seq++
+	name := fmt.Sprintf("%s_%04d.eml", time.Now().Format("20060102150405"), m.seq)
+	m.mu.Unlock()
+	data = append([]byte("X-Envelope-To: "+strings.Join(e.Recipients(), ", ")+"\r\n"), data...)
+	return ioutil.WriteFile(filepath.Join(m.Folder, name), data, 0644)
+}
@@ -0,0 +1,195 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/CaboodleData/gotools/amazon"
+)
+
+// defaultLayout is used when there is no layout.html
+const defaultLayout = `{{template "content" .}}`
+
+// Templates are named emails, each with a subject, HTML and text template rendered with a data struct.
+// In a folder each email is a set of files with the same name:
+//
+//	workflowerror.subject  Workflow {{.Reason}} Occured
+//	workflowerror.html     the HTML body, put inside layout.html where it has {{template "content" .}}
+//	workflowerror.txt      optional, if missing the text is made from the HTML
+//
+// The subject and text use text/template, the HTML uses html/template so data is escaped.
+type Templates struct {
+	mu     sync.RWMutex
+	layout string
+	emails map[string]*emailTemplate
+}
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+// NewTemplates sets up the struc with a layout wrapping every HTML body, it may be empty
+func NewTemplates(layout string) *Templates {
+	if layout == "" {
+		layout = defaultLayout
+	}
+	return &Templates{layout: layout, emails: make(map[string]*emailTemplate)}
+}
+
+// LoadTemplates loads the templates from a folder
+func LoadTemplates(folder string) (*Templates, error) {
+	layout, err := ioutil.ReadFile(filepath.Join(folder, "layout.html"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	t := NewTemplates(string(layout))
+
+	subjects, err := filepath.Glob(filepath.Join(folder, "*.subject"))
+	if err != nil {
+		return nil, err
+	}
+	for _, subjectFile := range subjects {
+		name := strings.TrimSuffix(filepath.Base(subjectFile), ".subject")
+		subject, err := ioutil.ReadFile(subjectFile)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadFile(filepath.Join(folder, name+".html"))
+		if err != nil {
+			return nil, err
+		}
+		text, err := ioutil.ReadFile(filepath.Join(folder, name+".txt"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err = t.Add(name, string(subject), string(body), string(text)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Add adds or replaces a template, text may be empty to make it from the HTML
+func (t *Templates) Add(name string, subject string, body string, text string) error {
+	e := &emailTemplate{}
+	var err error
+	if e.subject, err = texttemplate.New(name).Parse(strings.TrimSpace(subject)); err != nil {
+		return err
+	}
+	if e.html, err = htmltemplate.New(name).Parse(t.layout); err != nil {
+		return err
+	}
+	if _, err = e.html.New("content").Parse(body); err != nil {
+		return err
+	}
+	if text != "" {
+		if e.text, err = texttemplate.New(name).Parse(text); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	t.emails[name] = e
+	t.mu.Unlock()
+	return nil
+}
+
+// Has checks if there is a template with this name
+func (t *Templates) Has(name string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.emails[name]
+	return ok
+}
+
+// Render renders a template into an Email with the subject, HTML and text set, ready for From and To
+func (t *Templates) Render(name string, data interface{}) (*amazon.Email, error) {
+	t.mu.RLock()
+	e, ok := t.emails[name]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("no email template " + name)
+	}
+	var subject, body, text bytes.Buffer
+	if err := e.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := e.html.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	email := &amazon.Email{
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		HTML:    body.String(),
+	}
+	if e.text != nil {
+		if err := e.text.Execute(&text, data); err != nil {
+			return nil, err
+		}
+		email.Text = text.String()
+	} else {
+		email.Text = HTMLToText(email.HTML)
+	}
+	return email, nil
+}
+
+// Send renders a template and sends it
+func (t *Templates) Send(m Mailer, name string, from string, to []string, data interface{}) error {
+	e, err := t.Render(name, data)
+	if err != nil {
+		return err
+	}
+	e.From = from
+	e.To = to
+	return m.Send(e)
+}
+
+var (
+	reHidden    = regexp.MustCompile(`(?is)<(head|style|script)[^>]*>.*?</(head|style|script)>`)
+	reLink      = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a>`)
+	reListItem  = regexp.MustCompile(`(?i)<li[^>]*>`)
+	reLineBreak = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|tr|table|ul|ol)>`)
+	reCell      = regexp.MustCompile(`(?i)</t[dh]>`)
+	reTag       = regexp.MustCompile(`(?s)<[^>]*>`)
+	reSpaces    = regexp.MustCompile(`[ \t\r\f\v]+`)
+	reBlank     = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText makes the plain text version of an HTML email, keeping line breaks and link addresses
+func HTMLToText(s string) string {
+	s = reHidden.ReplaceAllString(s, "")
+	s = reLink.ReplaceAllStringFunc(s, func(a string) string {
+		m := reLink.FindStringSubmatch(a)
+		label := strings.TrimSpace(reTag.ReplaceAllString(m[2], ""))
+		href := html.UnescapeString(m[1])
+		if label == "" || html.UnescapeString(label) == href {
+			return href
+		}
+		return label + " (" + href + ")"
+	})
+	s = strings.Replace(s, "\n", " ", -1)
+	s = reListItem.ReplaceAllString(s, "\n- ")
+	s = reLineBreak.ReplaceAllString(s, "\n")
+	s = reCell.ReplaceAllString(s, " ")
+	s = reTag.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(reSpaces.ReplaceAllString(line, " "))
+	}
+	s = strings.Join(lines, "\n")
+	return strings.TrimSpace(reBlank.ReplaceAllString(s, "\n\n")) + "\n"
+}
@@ -0,0 +1,79 @@
+package mail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"plain", "Sales attached", "Sales attached\n"},
+		{"paragraphs", "<p>Dear Shaun</p><p>Sales attached</p>", "Dear Shaun\nSales attached\n"},
+		{"line breaks", "one<br>two<br/>three<BR />four", "one\ntwo\nthree\nfour\n"},
+		{"source newlines", "<p>Sales\n   attached</p>", "Sales attached\n"},
+		{"head and style", "<html><head><title>x</title><style>p {color: red}</style></head><body><p>Hi</p></body></html>", "Hi\n"},
+		{"script", "<script type=\"text/javascript\">alert('x')</script>Hi", "Hi\n"},
+		{"link", `See <a href="https://rapidtrade.biz/orders?id=1&amp;s=2">the orders</a>`, "See the orders (https://rapidtrade.biz/orders?id=1&s=2)\n"},
+		{"link same as label", `<a href="https://rapidtrade.biz">https://rapidtrade.biz</a>`, "https://rapidtrade.biz\n"},
+		{"link with no label", `<a href="https://rapidtrade.biz"><img src="cid:logo"></a>`, "https://rapidtrade.biz\n"},
+		{"list", "<ul><li>one</li><li>two</li></ul>", "- one\n- two\n"},
+		{"table", "<table><tr><th>Supplier</th><th>Orders</th></tr><tr><td>1234</td><td>56</td></tr></table>", "Supplier Orders\n1234 56\n"},
+		{"entities", "<p>Fish &amp; chips &lt;3</p>", "Fish & chips <3\n"},
+		{"blank lines", "<p>one</p><br><br><br><br><p>two</p>", "one\n\ntwo\n"},
+	}
+	for _, tt := range tests {
+		if got := HTMLToText(tt.html); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	folder, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	files := map[string]string{
+		"layout.html":           `<html><body>{{template "content" .}}</body></html>`,
+		"workflowerror.subject": "Workflow {{.Reason}} Occured\n",
+		"workflowerror.html":    "<p>{{.Reason}} in {{.WorkflowID}}</p>",
+		"workflowerror.txt":     "{{.Reason}} in {{.WorkflowID}}",
+		"slaescalation.subject": "SLA missed by {{.WorkflowID}}",
+		"slaescalation.html":    "<p>{{.WorkflowID}} is late</p>",
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(folder, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := struct{ Reason, WorkflowID string }{"ActivityTaskFailed", "supplierload-1234"}
+
+	templates, err := LoadTemplates(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := templates.Render("workflowerror", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Subject != "Workflow ActivityTaskFailed Occured" || e.HTML != "<html><body><p>ActivityTaskFailed in supplierload-1234</p></body></html>" || e.Text != "ActivityTaskFailed in supplierload-1234" {
+		t.Errorf("workflowerror: got %q, %q, %q", e.Subject, e.HTML, e.Text)
+	}
+	// without a .txt file the text is made from the HTML
+	if e, err = templates.Render("slaescalation", data); err != nil || e.Text != "supplierload-1234 is late\n" {
+		t.Errorf("slaescalation: got %+v, %v", e, err)
+	}
+
+	// a subject without its HTML body is an error
+	os.Remove(filepath.Join(folder, "slaescalation.html"))
+	if _, err = LoadTemplates(folder); err == nil {
+		t.Error("expected an error for a missing HTML body")
+	}
+}
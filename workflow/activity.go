@@ -3,15 +3,18 @@ package workflow
 import (
 	"encoding/json"
 	"log"
+	"time"
 
+	"github.com/CaboodleData/gotools/amazon"
 	"github.com/CaboodleData/gotools/file"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/swf"
+	"golang.org/x/net/context"
 )
 
 //Activity structure holds the required data to deal with our workflow
 type Activity struct {
+	cfg         *amazon.Config
 	svc         *swf.SWF
 	tt          string // task token associated with this decision
 	input       string
@@ -20,6 +23,12 @@ type Activity struct {
 	swfDomain   string
 	swfTasklist string
 	swfIdentity string
+	// HeartbeatInterval is how often a running activity heartbeats to SWF to pick up cancel requests
+	HeartbeatInterval time.Duration
+	// Limits optionally rate limits this task list and its activity types, see LoadLimits
+	Limits *Limits
+	// Health optionally reports the poll loop and running task to an orchestrator, see NewHealth
+	Health *Health
 }
 
 var (
@@ -28,20 +37,34 @@ var (
 )
 
 // NewActivity sets up the struc
-func NewActivity(swfDomain string, swfTasklist string, swfIdentity string) *Activity {
+func NewActivity(cfg *amazon.Config, swfDomain string, swfTasklist string, swfIdentity string) *Activity {
 	a := &Activity{
+		cfg:         cfg,
 		swfDomain:   swfDomain,
 		swfTasklist: swfTasklist,
 		swfIdentity: swfIdentity,
+
+		HeartbeatInterval: 30 * time.Second,
 	}
 	return a
 }
 
 //StartPolling start the polling, ensure to pass in the call back function to handle the activity
 func (a *Activity) StartPolling(stdout bool, logfolder string, handleActivity func(name string, input string) (result string, err error)) error {
+	return a.StartPollingContext(stdout, logfolder, func(ctx context.Context, name string, input string) (string, error) {
+		return handleActivity(name, input)
+	})
+}
+
+// StartPollingContext is the same as StartPolling, but the call back receives a context which is cancelled
+// when the decider requests cancellation of the running activity. The handler should stop as soon as ctx is done.
+func (a *Activity) StartPollingContext(stdout bool, logfolder string, handleActivity func(ctx context.Context, name string, input string) (result string, err error)) error {
 	Info, Error = file.InitLogs(stdout, logfolder, a.swfTasklist)
 	Info.Println("Starting " + a.swfIdentity + " ==>")
-	swfsvc := swf.New(session.New(), &aws.Config{Region: aws.String("us-east-1")})
+	swfsvc, err := amazon.SWFNewSession(a.cfg)
+	if err != nil {
+		return err
+	}
 
 	params := &swf.PollForActivityTaskInput{
 		Domain: aws.String(a.swfDomain), //
@@ -54,8 +77,13 @@ func (a *Activity) StartPolling(stdout bool, logfolder string, handleActivity fu
 
 	// loop forever while polling for work
 	x := 0
+	tasklistLimit := a.Limits.taskList(a.swfTasklist)
 	for {
+		// back off until the task list limits allow another task, rather than accept one we cannot start
+		start, cancel := tasklistLimit.reserve()
+		a.Health.beat()
 		resp, err := swfsvc.PollForActivityTask(params)
+		a.Health.polled(err)
 		if err != nil {
 			Error.Fatalf("error: unable to poll for decision: %v\n", err)
 		}
@@ -70,15 +98,16 @@ func (a *Activity) StartPolling(stdout bool, logfolder string, handleActivity fu
 				a.input = *resp.Input
 				a.name = *resp.ActivityType.Name
 
-				result, err := handleActivity(a.name, a.input)
-				if err != nil {
-					Info.Printf("Error sending POD: \n" + a.input)
-					a.TaskFailed(err.Error())
-				} else {
-					a.TaskCompleted(result)
-				}
+				release := start()
+				done := a.Health.taskStarted(a.name, a.swfTasklist, aws.StringValue(resp.WorkflowExecution.WorkflowId))
+				a.runActivity(a.Limits.limitActivity(handleActivity, nil))
+				done()
+				release()
+			} else {
+				cancel()
 			}
 		} else {
+			cancel()
 			// Every 20 minutes check in, just so we have some log activity
 			x++
 			if x == 20 {
@@ -89,6 +118,76 @@ func (a *Activity) StartPolling(stdout bool, logfolder string, handleActivity fu
 	}
 }
 
+// runActivity runs the handler while heartbeating, translating a cancel request into context cancellation
+func (a *Activity) runActivity(handleActivity func(ctx context.Context, name string, input string) (string, error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go a.heartbeat(a.tt, cancel, done)
+
+	result, err := handleActivity(ctx, a.name, a.input)
+	close(done)
+	// if the context was cancelled before we got here then the decider asked us to cancel
+	canceled := ctx.Err() != nil
+	cancel()
+
+	switch {
+	case canceled:
+		details := "Activity cancelled by request"
+		if err != nil {
+			details = err.Error()
+		}
+		a.TaskCanceled(details)
+	case err != nil:
+		Info.Printf("Error sending POD: \n" + a.input)
+		a.TaskFailed(err.Error())
+	default:
+		a.TaskCompleted(result)
+	}
+}
+
+// heartbeat records a heartbeat every HeartbeatInterval until done is closed.
+// If SWF tells us cancel was requested, cancel is called so the handler can stop.
+func (a *Activity) heartbeat(tt string, cancel context.CancelFunc, done <-chan struct{}) {
+	if a.HeartbeatInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			resp, err := a.svc.RecordActivityTaskHeartbeat(&swf.RecordActivityTaskHeartbeatInput{
+				TaskToken: aws.String(tt),
+			})
+			if err != nil {
+				Error.Printf("error: unable to record heartbeat: %v\n", err)
+				continue
+			}
+			if resp.CancelRequested != nil && *resp.CancelRequested {
+				Info.Printf("Cancel requested for %s", a.name)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// TaskCanceled is used to acknowledge a cancel request so the decider can close the workflow
+func (a *Activity) TaskCanceled(details string) error {
+	Info.Printf("Setting task as cancelled %s", a.name)
+	canparams := &swf.RespondActivityTaskCanceledInput{
+		Details:   aws.String(details),
+		TaskToken: aws.String(a.tt),
+	}
+	_, err := a.svc.RespondActivityTaskCanceled(canparams)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // TaskFailed is used to complete to fail this activity so the decider can take action
 func (a *Activity) TaskFailed(reason string) error {
 	Info.Printf("Setting task as failed %s", a.name)
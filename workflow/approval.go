@@ -0,0 +1,341 @@
+package workflow
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/mail"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// Names used in the workflow history for approvals
+const (
+	approvalSignal          = "approval"
+	approvalRequestedMarker = "ApprovalRequested"
+	approvalDecidedMarker   = "ApprovalDecided"
+	approvalTimerPrefix     = "approval-" // SWF does not allow : / or | in a timer id
+)
+
+// Approval outcomes handed to handleDecision
+const (
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+	ApprovalExpired  = "expired"
+)
+
+// defaultApprovalExpiry is one day, in seconds
+const defaultApprovalExpiry = "86400"
+
+// Approval makes a NextActivity wait for a person to approve it instead of scheduling an activity.
+// The decider emails approve and reject links to To, then waits for the link to be clicked or for Expiry to pass.
+// handleDecision is then called with the NextActivity name as the last activity and an ApprovalResult as JSON.
+// The Decider must have Approvals set.
+type Approval struct {
+	To      string
+	Subject string
+	Message string // HTML, the links are added after it
+	Expiry  string // seconds to wait, one day if empty
+	Data    string // handed back in the ApprovalResult
+}
+
+// ApprovalResult is the result handed to handleDecision once an approval is decided
+type ApprovalResult struct {
+	ID      string
+	Outcome string // approved, rejected or expired
+	Data    string
+}
+
+// approvalRequest is the detail of the ApprovalRequested marker
+type approvalRequest struct {
+	ID      string
+	Name    string
+	To      string
+	Data    string
+	Expires time.Time
+}
+
+// approvalToken is signed and put in the approve and reject links
+type approvalToken struct {
+	WorkflowID string `json:"w"`
+	RunID      string `json:"r"`
+	ID         string `json:"i"`
+	Outcome    string `json:"o"`
+	Expires    int64  `json:"e"`
+}
+
+// Approvals signs the approve and reject links and handles them when clicked.
+// Set it on the Decider, and serve Handler at URL, eg.
+//
+//	a := workflow.NewApprovals(cfg, "rapidtrade", "https://workflow.rapidtrade.biz/approval", secret)
+//	d.Approvals = a
+//	http.Handle("/approval", a.Handler())
+type Approvals struct {
+	URL    string
+	From   string      // who the approval emails come from
+	Mailer mail.Mailer // optionally sends the approval emails, they go straight through SES when nil
+	// Templates optionally replaces the approval email, see ApprovalData
+	Templates *mail.Templates
+	secret    []byte
+
+	cfg       *amazon.Config
+	swfDomain string
+	mu        sync.Mutex
+	svc       *swf.SWF
+}
+
+// NewApprovals sets up the struc, the secret signs the links so keep it out of source control
+func NewApprovals(cfg *amazon.Config, swfDomain string, url string, secret []byte) *Approvals {
+	return &Approvals{
+		URL:       url,
+		From:      "support@rapidtrade.biz",
+		secret:    secret,
+		cfg:       cfg,
+		swfDomain: swfDomain,
+	}
+}
+
+// sign returns the token for the link as base64 JSON, a dot, and the base64 HMAC of that
+func (a *Approvals) sign(t *approvalToken) string {
+	b, _ := json.Marshal(t)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature and expiry of a token
+func (a *Approvals) verify(token string) (*approvalToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("invalid token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("invalid token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	t := &approvalToken{}
+	if err = json.Unmarshal(b, t); err != nil {
+		return nil, errors.New("invalid token")
+	}
+	if t.Outcome != ApprovalApproved && t.Outcome != ApprovalRejected {
+		return nil, errors.New("invalid token")
+	}
+	if time.Now().Unix() > t.Expires {
+		return nil, errors.New("this link has expired")
+	}
+	return t, nil
+}
+
+// link builds the approve or reject link for an approval
+func (a *Approvals) link(dc *DecisionContext, id string, outcome string, expires time.Time) string {
+	token := a.sign(&approvalToken{
+		WorkflowID: dc.workflowID,
+		RunID:      dc.runID,
+		ID:         id,
+		Outcome:    outcome,
+		Expires:    expires.Unix(),
+	})
+	return a.URL + "?token=" + url.QueryEscape(token)
+}
+
+// send emails the approve and reject links
+func (a *Approvals) send(dc *DecisionContext, id string, approval *Approval, expires time.Time) error {
+	data := &ApprovalData{
+		Subject:      approval.Subject,
+		Message:      template.HTML(approval.Message),
+		WorkflowID:   dc.workflowID,
+		WorkflowType: dc.workflowType,
+		ApproveURL:   a.link(dc, id, ApprovalApproved, expires),
+		RejectURL:    a.link(dc, id, ApprovalRejected, expires),
+		Expires:      expires,
+	}
+	return sendTemplate(a.cfg, a.Mailer, a.Templates, "approval", a.From, approval.To, data)
+}
+
+// service returns the SWF client used to signal workflows, it is created once
+func (a *Approvals) service() (*swf.SWF, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.svc != nil {
+		return a.svc, nil
+	}
+	svc, err := amazon.SWFNewSession(a.cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.svc = svc
+	return svc, nil
+}
+
+// confirmPage is shown when a link is opened. The workflow is only signalled once the button is pressed,
+// so mail scanners that open links do not approve anything.
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Workflow approval</title></head>
+<body style="font-family:sans-serif">
+<p>Workflow {{.WorkflowID}}</p>
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">{{if eq .Outcome "approved"}}Approve{{else}}Reject{{end}}</button>
+</form>
+</body></html>`))
+
+// Handler returns the HTTP handler for the approve and reject links.
+// A GET shows a confirm button, the POST it makes validates the token and signals the workflow.
+func (a *Approvals) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+		t, err := a.verify(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			confirmPage.Execute(w, map[string]string{"WorkflowID": t.WorkflowID, "Token": token, "Outcome": t.Outcome})
+		case "POST":
+			if err = a.signal(t); err != nil {
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "UnknownResourceFault" {
+					http.Error(w, "This workflow is no longer running", http.StatusGone)
+					return
+				}
+				Error.Printf("error: unable to signal approval for %s: %v\n", t.WorkflowID, err)
+				http.Error(w, "Unable to record your decision, please try again", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "Thank you, workflow %s has been %s\n", t.WorkflowID, t.Outcome)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// signal sends the approval signal to the workflow
+func (a *Approvals) signal(t *approvalToken) error {
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	b, _ := json.Marshal(ApprovalResult{ID: t.ID, Outcome: t.Outcome})
+	_, err = svc.SignalWorkflowExecution(&swf.SignalWorkflowExecutionInput{
+		Domain:     aws.String(a.swfDomain),
+		WorkflowId: aws.String(t.WorkflowID),
+		RunId:      aws.String(t.RunID),
+		SignalName: aws.String(approvalSignal),
+		Input:      aws.String(string(b)),
+	})
+	return err
+}
+
+// approvalDecisions emails the links and returns the decisions that record the request and start the expiry timer
+func (d *Decider) approvalDecisions(dc *DecisionContext, next *NextActivity) ([]*swf.Decision, error) {
+	if d.Approvals == nil {
+		return nil, errors.New("approval requested but the decider has no Approvals set")
+	}
+	expiry := next.Approval.Expiry
+	if expiry == "" {
+		expiry = defaultApprovalExpiry
+	}
+	sec, err := strconv.Atoi(expiry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid approval expiry %s: %v", expiry, err)
+	}
+	id := next.Name + time.Now().Format("20060102150405")
+	expires := time.Now().Add(time.Duration(sec) * time.Second)
+	Info.Printf("Requesting approval %s from %s\n", id, next.Approval.To)
+	if err = d.Approvals.send(dc, id, next.Approval, expires); err != nil {
+		return nil, err
+	}
+	b, _ := json.Marshal(approvalRequest{ID: id, Name: next.Name, To: next.Approval.To, Data: next.Approval.Data, Expires: expires})
+	return []*swf.Decision{
+		d.markerDecision(approvalRequestedMarker, string(b)),
+		d.startTimerDecision(approvalTimerPrefix+id, expiry, ""),
+	}, nil
+}
+
+// getApprovalRequest finds the request for an approval, and whether it has already been decided
+func (d *Decider) getApprovalRequest(events []*swf.HistoryEvent, id string) (*approvalRequest, bool) {
+	var request *approvalRequest
+	decided := false
+	for _, event := range events {
+		if *event.EventType != "MarkerRecorded" {
+			continue
+		}
+		attrs := event.MarkerRecordedEventAttributes
+		switch *attrs.MarkerName {
+		case approvalRequestedMarker:
+			r := &approvalRequest{}
+			json.Unmarshal([]byte(aws.StringValue(attrs.Details)), r)
+			if r.ID == id {
+				request = r
+			}
+		case approvalDecidedMarker:
+			var r ApprovalResult
+			json.Unmarshal([]byte(aws.StringValue(attrs.Details)), &r)
+			if r.ID == id {
+				decided = true
+			}
+		}
+	}
+	return request, decided
+}
+
+// handleApprovalSignal handles an approve or reject link being clicked
+func (d *Decider) handleApprovalSignal(dc *DecisionContext, event *swf.HistoryEvent, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error)) error {
+	var signal ApprovalResult
+	json.Unmarshal([]byte(aws.StringValue(event.WorkflowExecutionSignaledEventAttributes.Input)), &signal)
+	decisions := []*swf.Decision{{
+		DecisionType: aws.String("CancelTimer"),
+		CancelTimerDecisionAttributes: &swf.CancelTimerDecisionAttributes{
+			TimerId: aws.String(approvalTimerPrefix + signal.ID),
+		},
+	}}
+	return d.decideApproval(dc, signal.ID, signal.Outcome, decisions, handleDecision)
+}
+
+// handleApprovalExpired handles the expiry timer of an approval firing
+func (d *Decider) handleApprovalExpired(dc *DecisionContext, timerID string, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error)) error {
+	return d.decideApproval(dc, strings.TrimPrefix(timerID, approvalTimerPrefix), ApprovalExpired, nil, handleDecision)
+}
+
+// decideApproval records the outcome and passes it to handleDecision. Links clicked twice, or after the
+// approval expired, are ignored as the first outcome recorded wins.
+func (d *Decider) decideApproval(dc *DecisionContext, id string, outcome string, decisions []*swf.Decision, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error)) error {
+	request, decided := d.getApprovalRequest(dc.events, id)
+	if request == nil || decided {
+		Info.Printf("Ignoring approval %s %s, already decided or unknown\n", id, outcome)
+		return d.respondDecisions(dc, nil, "Data")
+	}
+	Info.Printf("Approval %s %s\n", id, outcome)
+	b, _ := json.Marshal(ApprovalResult{ID: id, Outcome: outcome, Data: request.Data})
+	decisions = append(decisions, d.markerDecision(approvalDecidedMarker, string(b)))
+
+	next, err := handleDecision(d, dc, request.Name, string(b))
+	if err != nil {
+		return err
+	}
+	return d.respondNext(dc, decisions, next)
+}
@@ -0,0 +1,61 @@
+package workflow
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovalTokenRoundTrip(t *testing.T) {
+	a := NewApprovals(nil, "rapidtrade", "https://workflow.rapidtrade.biz/approval", []byte("secret"))
+	want := &approvalToken{
+		WorkflowID: "supplierload-1234",
+		RunID:      "22Qz5Dl7mLqz",
+		ID:         "1234-approval-5",
+		Outcome:    ApprovalApproved,
+		Expires:    time.Now().Add(time.Hour).Unix(),
+	}
+	got, err := a.verify(a.sign(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestApprovalTokenInvalid(t *testing.T) {
+	a := NewApprovals(nil, "rapidtrade", "https://workflow.rapidtrade.biz/approval", []byte("secret"))
+	valid := &approvalToken{WorkflowID: "supplierload-1234", ID: "5", Outcome: ApprovalRejected, Expires: time.Now().Add(time.Hour).Unix()}
+	token := a.sign(valid)
+	payload := token[:strings.Index(token, ".")]
+	sig := token[strings.Index(token, ".")+1:]
+
+	// a payload re-encoded with a different outcome but the original signature
+	b, _ := json.Marshal(&approvalToken{WorkflowID: "supplierload-1234", ID: "5", Outcome: ApprovalApproved, Expires: valid.Expires})
+	changed := base64.RawURLEncoding.EncodeToString(b) + "." + sig
+
+	other := NewApprovals(nil, "rapidtrade", "https://workflow.rapidtrade.biz/approval", []byte("other secret"))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no signature", payload},
+		{"extra part", token + ".x"},
+		{"signature not base64", payload + ".!!"},
+		{"changed outcome", changed},
+		{"truncated signature", token[:len(token)-2]},
+		{"other secret", other.sign(valid)},
+		{"expired", a.sign(&approvalToken{WorkflowID: "supplierload-1234", ID: "5", Outcome: ApprovalApproved, Expires: time.Now().Add(-time.Minute).Unix()})},
+		{"expired outcome", a.sign(&approvalToken{WorkflowID: "supplierload-1234", ID: "5", Outcome: ApprovalExpired, Expires: valid.Expires})},
+	}
+	for _, tt := range tests {
+		if got, err := a.verify(tt.token); err == nil {
+			t.Errorf("%s: expected an error, got %+v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/file"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// redriveTag is added to the tag list of a re-driven workflow so the decider starts it from the failed step
+const redriveTag = "redrive:"
+
+// FailedExecution is what we keep about a failed workflow so that it outlives the SWF retention period
+// and can be re-driven later
+type FailedExecution struct {
+	ID                     string
+	Domain                 string
+	WorkflowID             string
+	RunID                  string
+	WorkflowType           string
+	WorkflowVersion        string
+	TaskList               string
+	Tags                   []string
+	Input                  string
+	FailedActivity         string
+	FailedActivityVersion  string
+	FailedActivityTaskList string
+	FailedActivityInput    string
+	FailedLambda           bool // FailedActivity is a Lambda function
+	Reason                 string
+	Details                string
+	Started                time.Time
+	Failed                 time.Time
+}
+
+// DeadLetterStore keeps failed executions, use FolderDeadLetters or S3DeadLetters
+type DeadLetterStore interface {
+	Put(f *FailedExecution) error
+	Get(id string) (*FailedExecution, error)
+	List() ([]string, error)
+	Delete(id string) error
+}
+
+// FolderDeadLetters keeps failed executions as JSON files in a local folder
+type FolderDeadLetters struct {
+	Folder string
+}
+
+// Put saves the failed execution as <ID>.json
+func (s *FolderDeadLetters) Put(f *FailedExecution) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.Folder, 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Folder, f.ID+".json"), b, 0666)
+}
+
+// Get loads a failed execution by ID
+func (s *FolderDeadLetters) Get(id string) (*FailedExecution, error) {
+	f := &FailedExecution{}
+	if err := file.LoadJSON(filepath.Join(s.Folder, id+".json"), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// List returns the IDs of all failed executions in the folder
+func (s *FolderDeadLetters) List() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(s.Folder, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, name := range names {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(name), ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Delete removes a failed execution, eg. once it has been re-driven successfully
+func (s *FolderDeadLetters) Delete(id string) error {
+	return os.Remove(filepath.Join(s.Folder, id+".json"))
+}
+
+// S3DeadLetters keeps failed executions as JSON objects under a prefix in an S3 bucket
+type S3DeadLetters struct {
+	Config *amazon.Config
+	Bucket string
+	Prefix string
+}
+
+func (s *S3DeadLetters) key(id string) string {
+	return s.Prefix + id + ".json"
+}
+
+func (s *S3DeadLetters) service() (*s3.S3, error) {
+	sess, err := s.Config.Session()
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// Put saves the failed execution as <Prefix><ID>.json
+func (s *S3DeadLetters) Put(f *FailedExecution) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	svc, err := s.service()
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.key(f.ID)),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// Get loads a failed execution by ID
+func (s *S3DeadLetters) Get(id string) (*FailedExecution, error) {
+	svc, err := s.service()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	f := &FailedExecution{}
+	if err = json.NewDecoder(resp.Body).Decode(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// List returns the IDs of all failed executions under the prefix
+func (s *S3DeadLetters) List() ([]string, error) {
+	svc, err := s.service()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	params := &s3.ListObjectsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix),
+	}
+	err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(*object.Key, s.Prefix)
+			if strings.HasSuffix(key, ".json") {
+				ids = append(ids, strings.TrimSuffix(key, ".json"))
+			}
+		}
+		return true
+	})
+	return ids, err
+}
+
+// Delete removes a failed execution, eg. once it has been re-driven successfully
+func (s *S3DeadLetters) Delete(id string) error {
+	svc, err := s.service()
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	return err
+}
+
+// Redrive starts a failed workflow again with its original input and returns the new run id.
+// If fromFailedStep is true the decider skips straight to the activity that failed, with the input it had,
+// which needs the decider polling for the workflow to have the same DeadLetters store set.
+func Redrive(svc *swf.SWF, store DeadLetterStore, id string, fromFailedStep bool) (string, error) {
+	f, err := store.Get(id)
+	if err != nil {
+		return "", err
+	}
+	var tags []string
+	for _, tag := range f.Tags {
+		if !strings.HasPrefix(tag, redriveTag) {
+			tags = append(tags, tag)
+		}
+	}
+	if fromFailedStep {
+		if f.FailedActivity == "" {
+			return "", errors.New("No failed step recorded for " + id)
+		}
+		// SWF allows up to 5 tags, so make room for ours
+		if len(tags) > 4 {
+			tags = tags[:4]
+		}
+		tags = append(tags, redriveTag+id)
+	}
+	runid, err := amazon.SWFStartWorkflow(svc, f.Domain, f.WorkflowType, f.WorkflowVersion, "", f.Input, tags, f.TaskList)
+	if err != nil {
+		return "", err
+	}
+	return *runid, nil
+}
+
+// failedStep is the step a workflow failed on, so a re-drive can start from it
+type failedStep struct {
+	Activity string
+	Version  string
+	TaskList string
+	Input    string
+	Lambda   bool `json:",omitempty"`
+}
+
+// getFailedStep returns the latest step, activity or Lambda function, that failed or was scheduled but never closed.
+// Compensations are skipped, as by the time the workflow fails after compensating they are the latest activities run.
+func (d *Decider) getFailedStep(events []*swf.HistoryEvent) *failedStep {
+	scheduled := make(map[int64]*swf.ActivityTaskScheduledEventAttributes)
+	for _, event := range events {
+		if *event.EventType == "ActivityTaskScheduled" {
+			scheduled[*event.EventId] = event.ActivityTaskScheduledEventAttributes
+		}
+	}
+	for _, event := range events {
+		if step := d.getFailedLambda(events, event); step != nil {
+			return step
+		}
+		var attrs *swf.ActivityTaskScheduledEventAttributes
+		switch *event.EventType {
+		case "ActivityTaskScheduled":
+			attrs = event.ActivityTaskScheduledEventAttributes
+		case "ActivityTaskFailed", "ActivityTaskTimedOut":
+			attrs = scheduled[d.getScheduledEventID(event)]
+		}
+		if attrs == nil || d.getStepControl(attrs).CompensationFor != "" {
+			continue
+		}
+		return &failedStep{
+			Activity: *attrs.ActivityType.Name,
+			Version:  *attrs.ActivityType.Version,
+			TaskList: *attrs.TaskList.Name,
+			Input:    aws.StringValue(attrs.Input),
+		}
+	}
+	return nil
+}
+
+// getFailedLambda returns the Lambda function step of a scheduled or failed Lambda event, or nil for other events.
+// If it could not be scheduled its input is not in the history, so a re-drive runs it with no input.
+func (d *Decider) getFailedLambda(events []*swf.HistoryEvent, event *swf.HistoryEvent) *failedStep {
+	var attrs *swf.LambdaFunctionScheduledEventAttributes
+	switch *event.EventType {
+	case "LambdaFunctionScheduled":
+		attrs = event.LambdaFunctionScheduledEventAttributes
+	case "LambdaFunctionFailed":
+		attrs = d.getLambdaScheduled(events, *event.LambdaFunctionFailedEventAttributes.ScheduledEventId)
+	case "LambdaFunctionTimedOut":
+		attrs = d.getLambdaScheduled(events, *event.LambdaFunctionTimedOutEventAttributes.ScheduledEventId)
+	case "StartLambdaFunctionFailed":
+		attrs = d.getLambdaScheduled(events, aws.Int64Value(event.StartLambdaFunctionFailedEventAttributes.ScheduledEventId))
+	case "ScheduleLambdaFunctionFailed":
+		return &failedStep{Activity: *event.ScheduleLambdaFunctionFailedEventAttributes.Name, Lambda: true}
+	}
+	if attrs == nil {
+		return nil
+	}
+	return &failedStep{Activity: *attrs.Name, Input: aws.StringValue(attrs.Input), Lambda: true}
+}
+
+// deadLetter saves the failed execution to the DeadLetters store, if there is one.
+// If step is nil the failed step is worked out from the history.
+func (d *Decider) deadLetter(dc *DecisionContext, reason string, details string, step *failedStep) {
+	if d.DeadLetters == nil {
+		return
+	}
+	f := &FailedExecution{
+		ID:         dc.workflowID + time.Now().Format("_20060102150405"),
+		Domain:     d.swfDomain,
+		WorkflowID: dc.workflowID,
+		RunID:      dc.runID,
+		Reason:     reason,
+		Details:    details,
+		Failed:     time.Now(),
+	}
+
+	for _, event := range dc.events {
+		if *event.EventType == "WorkflowExecutionStarted" {
+			attrs := event.WorkflowExecutionStartedEventAttributes
+			f.WorkflowType = *attrs.WorkflowType.Name
+			f.WorkflowVersion = *attrs.WorkflowType.Version
+			f.TaskList = *attrs.TaskList.Name
+			f.Input = aws.StringValue(attrs.Input)
+			f.Started = *event.EventTimestamp
+			for _, tag := range attrs.TagList {
+				f.Tags = append(f.Tags, *tag)
+			}
+		}
+	}
+	if step == nil {
+		step = d.getFailedStep(dc.events)
+	}
+	if step != nil {
+		f.FailedActivity = step.Activity
+		f.FailedActivityVersion = step.Version
+		f.FailedActivityTaskList = step.TaskList
+		f.FailedActivityInput = step.Input
+		f.FailedLambda = step.Lambda
+	}
+
+	if err := d.DeadLetters.Put(f); err != nil {
+		Error.Printf("error: unable to save dead letter for %s: %v\n", dc.workflowID, err)
+		return
+	}
+	Info.Printf("Failed workflow saved as dead letter %s", f.ID)
+}
+
+// getScheduledEventID returns the id of the ActivityTaskScheduled event a closed activity event belongs to
+func (d *Decider) getScheduledEventID(event *swf.HistoryEvent) int64 {
+	switch *event.EventType {
+	case "ActivityTaskCompleted":
+		return *event.ActivityTaskCompletedEventAttributes.ScheduledEventId
+	case "ActivityTaskFailed":
+		return *event.ActivityTaskFailedEventAttributes.ScheduledEventId
+	case "ActivityTaskTimedOut":
+		return *event.ActivityTaskTimedOutEventAttributes.ScheduledEventId
+	case "ActivityTaskCanceled":
+		return *event.ActivityTaskCanceledEventAttributes.ScheduledEventId
+	}
+	return 0
+}
+
+// getRedrive returns the dead letter a workflow was re-driven from, or nil if it is a normal start.
+// It is an error if the dead letter cannot be loaded, as starting afresh would re-run the steps that completed.
+func (d *Decider) getRedrive(event *swf.HistoryEvent) (*FailedExecution, error) {
+	for _, tag := range event.WorkflowExecutionStartedEventAttributes.TagList {
+		if strings.HasPrefix(*tag, redriveTag) {
+			id := strings.TrimPrefix(*tag, redriveTag)
+			if d.DeadLetters == nil {
+				return nil, fmt.Errorf("re-driven from dead letter %s, but the decider has no DeadLetters", id)
+			}
+			f, err := d.DeadLetters.Get(id)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load dead letter %s to re-drive from: %v", id, err)
+			}
+			return f, nil
+		}
+	}
+	return nil, nil
+}
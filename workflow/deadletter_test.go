@@ -0,0 +1,67 @@
+package workflow
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+func startedEvent(tags ...string) *swf.HistoryEvent {
+	return &swf.HistoryEvent{
+		EventType: aws.String("WorkflowExecutionStarted"),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input:   aws.String("{}"),
+			TagList: aws.StringSlice(tags),
+		},
+	}
+}
+
+func TestGetRedrive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FolderDeadLetters{Folder: dir}
+	if err = store.Put(&FailedExecution{ID: "supplierload-1234_20170301060000", FailedActivity: "merge"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		store   DeadLetterStore
+		event   *swf.HistoryEvent
+		want    string // failed activity, empty for a normal start
+		wantErr bool
+	}{
+		{"normal start", store, startedEvent("supplier1234"), "", false},
+		{"normal start without store", nil, startedEvent(), "", false},
+		{"re-driven", store, startedEvent(redriveTag + "supplierload-1234_20170301060000"), "merge", false},
+		{"dead letter missing", store, startedEvent(redriveTag + "supplierload-1234_20170302060000"), "", true},
+		{"no store", nil, startedEvent(redriveTag + "supplierload-1234_20170301060000"), "", true},
+	}
+	for _, tt := range tests {
+		d := &Decider{DeadLetters: tt.store}
+		f, err := d.getRedrive(tt.event)
+		if tt.wantErr {
+			if err == nil || f != nil {
+				t.Errorf("%s: expected an error and no dead letter, got %v, %v", tt.name, f, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if f != nil {
+			got = f.FailedActivity
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -12,8 +12,8 @@ import (
 
 	"github.com/CaboodleData/gotools/amazon"
 	"github.com/CaboodleData/gotools/file"
+	"github.com/CaboodleData/gotools/mail"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/swf"
 )
 
@@ -33,12 +33,8 @@ var (
 
 //Decider structure holds the required data to deal with our workflow
 type Decider struct {
+	cfg                     *amazon.Config
 	svc                     *swf.SWF
-	tt                      string // task token associated with this decision
-	input                   string
-	name                    string
-	runid                   string //Workflows runid
-	workflowid              string //
 	ProjectID               string
 	swfDomain               string
 	SwfTasklist             string
@@ -46,22 +42,96 @@ type Decider struct {
 	swfFirstActivity        string
 	swfFirstActivityVersion string
 	swfFirstTaskList        string
+	// DeadLetters optionally keeps failed workflows so they can be looked at and re-driven, see Redrive
+	DeadLetters DeadLetterStore
+	// FirstActivity optionally sets the timeouts, priority and control of the first activity.
+	// Its name, version and tasklist come from NewDecider, when nil a start to close timeout of 10000 is used.
+	FirstActivity *NextActivity
+	// HandleTimeout is optionally called when an activity times out, with the timeout type that fired
+	// (START_TO_CLOSE, SCHEDULE_TO_START, SCHEDULE_TO_CLOSE or HEARTBEAT) and the control data it was scheduled with.
+	// Return the next activity, eg. a retry, or nil to just notify the helpdesk.
+	HandleTimeout func(d *Decider, dc *DecisionContext, activity string, timeoutType string, control string) (*NextActivity, error)
+	// Health optionally reports the poll loop and decisions in flight to an orchestrator, see NewHealth
+	Health *Health
+	// Events holds the optional callbacks for the other history events, see EventHandlers
+	Events EventHandlers
+	// Approvals signs and handles the links of approval steps, needed if any NextActivity has an Approval
+	Approvals *Approvals
+	// SLAs optionally sets the deadline of each workflow type, keyed by workflow type name, see SLA
+	SLAs map[string]*SLA
+	// Mailer optionally sends the helpdesk and SLA emails, they go straight through SES when nil
+	Mailer mail.Mailer
+	// Templates optionally replaces the workflowerror and slaescalation emails, see NotificationData
+	Templates *mail.Templates
+}
+
+// DecisionContext is the decision task being handled. A new one is made for each task and never changed,
+// so decisions can safely run concurrently. Pass it to every Decider function that responds to the task.
+type DecisionContext struct {
+	taskToken    string
+	runID        string
+	workflowID   string
+	workflowType string
+	events       []*swf.HistoryEvent
+	// escalations are SLA markers sent with whatever decision this task makes
+	escalations []*swf.Decision
+}
+
+// TaskToken is the token of the decision task, needed to respond to it
+func (dc *DecisionContext) TaskToken() string {
+	return dc.taskToken
+}
+
+// RunID is the run id of the workflow execution
+func (dc *DecisionContext) RunID() string {
+	return dc.runID
+}
+
+// WorkflowID is the workflow id of the workflow execution
+func (dc *DecisionContext) WorkflowID() string {
+	return dc.workflowID
+}
+
+// WorkflowType is the name of the workflow type
+func (dc *DecisionContext) WorkflowType() string {
+	return dc.workflowType
+}
+
+// Events is the workflow history, newest first. Do not change it.
+func (dc *DecisionContext) Events() []*swf.HistoryEvent {
+	return dc.events
 }
 
 // NextActivity bla
+// Timeouts are in seconds as strings, or "NONE". Leave them empty to use the defaults registered with the activity type.
 type NextActivity struct {
 	Name       string
 	Version    string
 	Input      string
-	StcTimeout string
+	StcTimeout string // start to close timeout
 	Tasklist   string
 	Context    string
 	Complete   bool
+
+	ScheduleToStartTimeout string
+	ScheduleToCloseTimeout string
+	HeartbeatTimeout       string
+	TaskPriority           string
+	// Control is kept with the scheduled activity and handed back to HandleTimeout
+	Control string
+	// Compensation optionally undoes this step if a later step fails
+	Compensation *Compensation
+	// Approval optionally waits for a person to approve instead of scheduling an activity, see Approval
+	Approval *Approval
+	// Lambda schedules Name as a Lambda function instead of an activity, with Input and StcTimeout.
+	// The workflow must be started with amazon.SWFLambdaRole set. Compensation is not supported on Lambda steps.
+	Lambda bool
 }
 
 // NewDecider sets up the struc
-func NewDecider(swfDomain string, swfTasklist string, swfIdentity string, swfFirstActivity string, swfFirstActivityVersion string, swfFirstTaskList string) *Decider {
+func NewDecider(cfg *amazon.Config, swfDomain string, swfTasklist string, swfIdentity string, swfFirstActivity string, swfFirstActivityVersion string, swfFirstTaskList string) *Decider {
 	d := &Decider{
+		cfg:                     cfg,
 		swfDomain:               swfDomain,
 		SwfTasklist:             swfTasklist,
 		swfIdentity:             swfIdentity,
@@ -73,14 +143,17 @@ func NewDecider(swfDomain string, swfTasklist string, swfIdentity string, swfFir
 }
 
 //StartDeciderPolling start the polling, ensure to pass in the call back function to handle the activity
-func (d *Decider) StartDeciderPolling(name string, stdout bool, logfolder string, logname string, handleDecision func(d *Decider, lastActivity string, result string) (*NextActivity, error), eventHandled func(event string)) error {
+func (d *Decider) StartDeciderPolling(name string, stdout bool, logfolder string, logname string, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error), eventHandled func(event string)) error {
 
 	// initialise logs
 	Info, Error = file.InitLogs(stdout, logfolder, logname)
 	Info.Println("Starting  Decider =================>")
 
 	// start workflow
-	swfsvc := swf.New(session.New(), &aws.Config{Region: aws.String("us-east-1")})
+	swfsvc, err := amazon.SWFNewSession(d.cfg)
+	if err != nil {
+		return err
+	}
 	params := &swf.PollForDecisionTaskInput{
 		Domain: aws.String(d.swfDomain), //
 		TaskList: &swf.TaskList{ //
@@ -91,29 +164,37 @@ func (d *Decider) StartDeciderPolling(name string, stdout bool, logfolder string
 		ReverseOrder:    aws.Bool(true),
 	}
 
+	d.svc = swfsvc
 	Info.Printf("Starting  polling for %s", d.SwfTasklist)
 	// loop forever while polling for work
 	cnt := 0
 	for {
-		resp, err := swfsvc.PollForDecisionTask(params)
+		d.Health.beat()
+		resp, err := d.pollForDecisionTask(swfsvc, params)
+		d.Health.polled(err)
 		if err != nil {
-			amazon.SESSendEmail("support@rapidtrade.biz", helpdesk, swfIdentity+" unable to pole", err.Error())
+			d.sendEmail("support@rapidtrade.biz", helpdesk, swfIdentity+" unable to pole", err.Error())
 			Error.Printf("error: unable to poll for decision: %v\n", err)
 			panic("Broken, check logs")
 		}
 
 		// if we do not receive a task token then 60 second time out occured so try again
-		if resp.TaskToken != nil {
-			if *resp.TaskToken != "" {
-				// Re-initialise logs so we get latest date
-				Info, Error = file.InitLogs(stdout, logfolder, logname)
-				d.svc = swfsvc
-				d.tt = *resp.TaskToken
-				d.runid = *resp.WorkflowExecution.RunId
-				d.workflowid = *resp.WorkflowExecution.WorkflowId
+		if resp.TaskToken != nil && *resp.TaskToken != "" {
+			// Re-initialise logs so we get latest date
+			Info, Error = file.InitLogs(stdout, logfolder, logname)
+			dc := &DecisionContext{
+				taskToken:    *resp.TaskToken,
+				runID:        *resp.WorkflowExecution.RunId,
+				workflowID:   *resp.WorkflowExecution.WorkflowId,
+				workflowType: *resp.WorkflowType.Name,
+				events:       resp.Events,
 			}
 			// make each decision in a goroutine which means that multiple decisions can be made
-			go d.makeDecision(resp.Events, resp.WorkflowExecution.RunId, handleDecision, eventHandled)
+			done := d.Health.taskStarted("decision", d.SwfTasklist, dc.workflowID)
+			go func() {
+				defer done()
+				d.makeDecision(dc, handleDecision, eventHandled)
+			}()
 		} else {
 			cnt++
 			if cnt > 30 {
@@ -124,57 +205,137 @@ func (d *Decider) StartDeciderPolling(name string, stdout bool, logfolder string
 	}
 }
 
-func (d *Decider) makeDecision(events []*swf.HistoryEvent, ID *string, handleDecision func(d *Decider, lastActivity string, result string) (*NextActivity, error), eventHandled func(event string)) {
-	var handled bool
+// pollForDecisionTask polls for a decision task and then fetches the rest of its history pages,
+// so decisions always see the whole workflow history
+func (d *Decider) pollForDecisionTask(swfsvc *swf.SWF, params *swf.PollForDecisionTaskInput) (*swf.PollForDecisionTaskOutput, error) {
+	resp, err := swfsvc.PollForDecisionTask(params)
+	if err != nil {
+		return nil, err
+	}
+	for resp.NextPageToken != nil && *resp.NextPageToken != "" {
+		pageParams := *params
+		pageParams.NextPageToken = resp.NextPageToken
+		page, err := swfsvc.PollForDecisionTask(&pageParams)
+		if err != nil {
+			return nil, err
+		}
+		resp.Events = append(resp.Events, page.Events...)
+		resp.NextPageToken = page.NextPageToken
+	}
+	return resp, nil
+}
+
+func (d *Decider) makeDecision(dc *DecisionContext, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error), eventHandled func(event string)) {
+	var handled, slaFired bool
 	var err error
+	events := dc.events
+
+	// SLA escalations that are due go out with whatever decision is made
+	escalations, terminate := d.slaDecisions(dc)
+	if len(escalations) > 0 {
+		withSLA := *dc
+		withSLA.escalations = escalations
+		dc = &withSLA
+	}
+
+	// once a cancel has been requested every decision works towards closing the workflow as cancelled
+	if d.isCancelRequested(events) {
+		if err = d.handleCancelRequested(dc); err != nil {
+			Info.Printf("Error cancelling workflow: %v\n", err)
+		}
+		go eventHandled("WorkflowExecutionCancelRequested")
+		return
+	}
+
+	// once compensation has started every decision works through the remaining compensations
+	if d.isCompensating(events) {
+		if err = d.handleCompensating(dc); err != nil {
+			Info.Printf("Error compensating workflow: %v\n", err)
+		}
+		return
+	}
+
+	// once the SLA has been missed for good every decision works towards failing the workflow
+	if terminate != nil {
+		if err = d.handleSLATerminate(dc, terminate); err != nil {
+			Error.Printf("error: unable to fail workflow: %v\n", err)
+		}
+		return
+	}
 
 	// loop backwards through time and make decisions
-	for k, event := range events {
+	for _, event := range events {
 		switch *event.EventType {
 		case "WorkflowExecutionStarted":
 			_ = "breakpoint"
-			d.handleWorkflowStart(event)
+			d.handleWorkflowStart(dc, event)
 			handled = true
 
 		case "ActivityTaskCompleted":
 			_ = "breakpoint"
 			lastActivity := d.getLastScheduledActivity(events)
-			nextactivity, err1 := handleDecision(d, lastActivity, *event.ActivityTaskCompletedEventAttributes.Result)
+			nextactivity, err1 := handleDecision(d, dc, lastActivity, *event.ActivityTaskCompletedEventAttributes.Result)
 			if err1 != nil {
-				d.emailError("ActivityTaskFailed")
-				d.failWorkflow(*event.ActivityTaskFailedEventAttributes.Reason, nil)
-			}
-			if nextactivity.Complete {
-				d.CompleteWorkflow(nextactivity.Input)
-				handled = true
+				d.emailError(dc, "ActivityTaskFailed")
+				d.failWithCompensation(dc, err1.Error(), nil)
+			} else if nextactivity.Complete {
+				d.CompleteWorkflow(dc, nextactivity.Input)
 			} else {
-				d.ScheduleNextActivity(nextactivity.Name, nextactivity.Version, nextactivity.Input, nextactivity.StcTimeout, nextactivity.Tasklist, nextactivity.Context)
+				d.ScheduleActivity(dc, nextactivity)
 			}
+			handled = true
 
 		case "ActivityTaskTimedOut":
-			d.handleTimeout()
+			err = d.handleActivityTimedOut(dc, event)
 			handled = true
 
 		case "ActivityTaskFailed":
 			Info.Println("Cancelling workflow")
-			d.emailError("ActivityTaskFailed")
-			d.failWorkflow(*event.ActivityTaskFailedEventAttributes.Reason, nil)
+			d.emailError(dc, "ActivityTaskFailed")
+			d.failWithCompensation(dc, *event.ActivityTaskFailedEventAttributes.Reason, nil)
 			handled = true
 
 		case "ActivityTaskCanceled":
-			d.failWorkflow("Workflow cancelled after activity cancelled", nil)
+			d.failWorkflow(dc, "Workflow cancelled after activity cancelled", nil)
+			handled = true
+
+		case "LambdaFunctionCompleted":
+			err = d.handleLambdaCompleted(dc, event, handleDecision)
 			handled = true
 
-		case "WorkflowExecutionCancelRequested":
-			d.failWorkflow("Workflow cancelled by request", nil)
+		case "LambdaFunctionTimedOut":
+			err = d.handleLambdaTimedOut(dc, event)
+			handled = true
+
+		case "LambdaFunctionFailed", "ScheduleLambdaFunctionFailed", "StartLambdaFunctionFailed":
+			d.handleLambdaFailed(dc, event)
 			handled = true
 
 		case "TimerFired":
-			err = d.handleTimerFired(k, events)
+			if d.isSLATimer(event) {
+				slaFired = true
+				break // the escalation is already in dc, carry on in case anything else in this task needs deciding
+			}
+			err = d.handleTimerFired(dc, event, handleDecision)
 			handled = true
 
+		case "DecisionTaskCompleted":
+			// we are back at the last decision with only SLA escalations to send
+			if slaFired || len(dc.escalations) > 0 {
+				err = d.respondDecisions(dc, nil, "Data")
+				handled = true
+			}
+
+		case "WorkflowExecutionSignaled":
+			if *event.WorkflowExecutionSignaledEventAttributes.SignalName == approvalSignal {
+				err = d.handleApprovalSignal(dc, event, handleDecision)
+				handled = true
+			} else {
+				handled, err = d.handleEvent(dc, event, handleDecision)
+			}
+
 		default:
-			//Info.Printf("Unhandled: %s\n", *event.EventType)
+			handled, err = d.handleEvent(dc, event, handleDecision)
 		}
 		go eventHandled(*event.EventType)
 		if handled == true {
@@ -185,14 +346,14 @@ func (d *Decider) makeDecision(events []*swf.HistoryEvent, ID *string, handleDec
 	if err != nil {
 		Info.Printf("Error making decision. workflow failed: %v\n", err)
 		// we are not able to process the workflow so fail it
-		err2 := d.failWorkflow("", err)
+		err2 := d.failWithCompensation(dc, "", err)
 		if err2 != nil {
 			Info.Printf("error while failing workflow: %v\n", err2)
 		}
 	}
 
 	if handled == false {
-		Info.Printf("debug dump of received event for taskToken: %s\n", d.tt)
+		Info.Printf("debug dump of received event for taskToken: %s\n", dc.taskToken)
 		Info.Println(events)
 		Info.Printf("xxxx debug unhandled decision\n")
 	}
@@ -211,55 +372,188 @@ func (d *Decider) getLastScheduledActivity(events []*swf.HistoryEvent) string {
 	return ""
 }
 
-func (d *Decider) handleTimerFired(k int, es []*swf.HistoryEvent) error {
-	return nil
+// isCancelRequested checks if anyone has asked for this workflow to be cancelled
+func (d *Decider) isCancelRequested(events []*swf.HistoryEvent) bool {
+	for _, event := range events {
+		if *event.EventType == "WorkflowExecutionCancelRequested" {
+			return true
+		}
+	}
+	return false
 }
 
-func (d *Decider) setTimer(sec, data, id string) error {
-	Info.Printf("debug start set timer to wait: %s seconds\n", sec)
+// getOpenActivities returns the activity ids of all scheduled activities that have not yet closed
+func (d *Decider) getOpenActivities(events []*swf.HistoryEvent) []string {
+	closed := make(map[int64]bool)
+	for _, event := range events {
+		if id := d.getScheduledEventID(event); id != 0 {
+			closed[id] = true
+		}
+	}
+	var open []string
+	for _, event := range events {
+		if *event.EventType == "ActivityTaskScheduled" && !closed[*event.EventId] {
+			open = append(open, *event.ActivityTaskScheduledEventAttributes.ActivityId)
+		}
+	}
+	return open
+}
 
-	params := &swf.RespondDecisionTaskCompletedInput{
-		TaskToken: aws.String(d.tt),
-		Decisions: []*swf.Decision{
-			{
-				DecisionType: aws.String("StartTimer"),
-				StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
-					StartToFireTimeout: aws.String(sec),
-					TimerId:            aws.String(id),
-					Control:            aws.String(data),
-				},
+// handleCancelRequested asks SWF to cancel every open activity, then once they have all closed, cancels the workflow
+func (d *Decider) handleCancelRequested(dc *DecisionContext) error {
+	open, decisions, err := d.cancelActivityDecisions(dc)
+	if err != nil {
+		return d.failWorkflow(dc, "", err)
+	}
+	if len(open) == 0 {
+		Info.Println("Cancelling workflow")
+		decisions = append(decisions, &swf.Decision{
+			DecisionType: aws.String("CancelWorkflowExecution"),
+			CancelWorkflowExecutionDecisionAttributes: &swf.CancelWorkflowExecutionDecisionAttributes{
+				Details: aws.String("Workflow cancelled by request"),
 			},
-		},
-		ExecutionContext: aws.String("ssec2-amicreate"),
+		})
 	}
-	_, err := d.svc.RespondDecisionTaskCompleted(params)
-	return err
+	return d.respondDecisions(dc, decisions, "Data")
 }
 
-// handleTimeout will send an email if the first timeout, then set marker so next time we dont email
-func (d *Decider) handleTimeout() error {
-	to, _ := d.emailError("Activity Timeout")
-	params := &swf.RespondDecisionTaskCompletedInput{
-		TaskToken: aws.String(d.tt),
-		Decisions: []*swf.Decision{
-			{
-				DecisionType: aws.String("RecordMarker"),
-				RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{
-					MarkerName: aws.String("HelpdeskNotified"),
-					Details:    aws.String(to),
-				},
+// cancelActivityDecisions returns the open activities and a cancel request for each one not yet asked.
+// An activity SWF would not cancel is not asked again, we wait for it to close on its own. Each one refused
+// since the last decision goes to the RequestCancelActivityTaskFailed callback, whose error fails the workflow.
+func (d *Decider) cancelActivityDecisions(dc *DecisionContext) (open []string, decisions []*swf.Decision, err error) {
+	requested := make(map[string]bool)
+	latest := true // still in the events since the last decision
+	for _, event := range dc.events {
+		switch *event.EventType {
+		case "DecisionTaskCompleted":
+			latest = false
+		case "ActivityTaskCancelRequested":
+			requested[*event.ActivityTaskCancelRequestedEventAttributes.ActivityId] = true
+		case "RequestCancelActivityTaskFailed":
+			attrs := event.RequestCancelActivityTaskFailedEventAttributes
+			requested[*attrs.ActivityId] = true
+			if !latest {
+				continue
+			}
+			Info.Printf("Unable to cancel activity %s: %s\n", *attrs.ActivityId, *attrs.Cause)
+			if d.Events.RequestCancelActivityTaskFailed != nil && err == nil {
+				_, err = d.Events.RequestCancelActivityTaskFailed(d, dc, attrs)
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	open = d.getOpenActivities(dc.events)
+	for _, id := range open {
+		if requested[id] {
+			continue // already asked, waiting on the activity to acknowledge
+		}
+		Info.Printf("Requesting cancel of activity %s\n", id)
+		decisions = append(decisions, &swf.Decision{
+			DecisionType: aws.String("RequestCancelActivityTask"),
+			RequestCancelActivityTaskDecisionAttributes: &swf.RequestCancelActivityTaskDecisionAttributes{
+				ActivityId: aws.String(id),
 			},
-		},
-		ExecutionContext: aws.String("Data"),
+		})
+	}
+	return open, decisions, nil
+}
+
+// respondDecisions completes the decision task with the given decisions, which may be empty,
+// plus any SLA escalations due
+func (d *Decider) respondDecisions(dc *DecisionContext, decisions []*swf.Decision, context string) error {
+	if len(dc.escalations) > 0 {
+		decisions = append(append([]*swf.Decision(nil), dc.escalations...), decisions...)
+	}
+	params := &swf.RespondDecisionTaskCompletedInput{
+		TaskToken:        aws.String(dc.taskToken),
+		Decisions:        decisions,
+		ExecutionContext: aws.String(context),
 	}
 	_, err := d.svc.RespondDecisionTaskCompleted(params)
-	return err // which may be nil
+	return err
 }
 
-func (d *Decider) emailError(reason string) (string, error) {
-	runid := strings.Replace(d.runid, "=", "!=", 1)
-	msg := "https://console.aws.amazon.com/swf/home?region=us-east-1#execution_events:domain=" + swfDomain + ";workflowId=" + d.workflowid + ";runId=" + runid
-	err := amazon.SESSendEmail("support@rapidtrade.biz", helpdesk, "Workflow "+reason+" Occured", msg)
+// handleTimerFired passes our own timers on to what set them, other timers need no decision
+func (d *Decider) handleTimerFired(dc *DecisionContext, event *swf.HistoryEvent, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error)) error {
+	timerID := *event.TimerFiredEventAttributes.TimerId
+	if strings.HasPrefix(timerID, approvalTimerPrefix) {
+		return d.handleApprovalExpired(dc, timerID, handleDecision)
+	}
+	Info.Printf("Timer %s fired\n", timerID)
+	return d.respondDecisions(dc, nil, "Data")
+}
+
+func (d *Decider) setTimer(dc *DecisionContext, sec, data, id string) error {
+	Info.Printf("debug start set timer to wait: %s seconds\n", sec)
+	return d.respondDecisions(dc, []*swf.Decision{d.startTimerDecision(id, sec, data)}, "ssec2-amicreate")
+}
+
+func (d *Decider) startTimerDecision(id string, sec string, control string) *swf.Decision {
+	attrs := &swf.StartTimerDecisionAttributes{
+		StartToFireTimeout: aws.String(sec),
+		TimerId:            aws.String(id),
+	}
+	if control != "" {
+		attrs.Control = aws.String(control)
+	}
+	return &swf.Decision{
+		DecisionType:                 aws.String("StartTimer"),
+		StartTimerDecisionAttributes: attrs,
+	}
+}
+
+// handleActivityTimedOut passes the timeout to HandleTimeout if we have one, otherwise notifies the helpdesk
+func (d *Decider) handleActivityTimedOut(dc *DecisionContext, event *swf.HistoryEvent) error {
+	attrs := event.ActivityTaskTimedOutEventAttributes
+	timeoutType := *attrs.TimeoutType
+	scheduled := d.getScheduledEvent(dc.events, *attrs.ScheduledEventId)
+	if scheduled == nil {
+		return d.handleTimeout(dc, timeoutType)
+	}
+	name := *scheduled.ActivityTaskScheduledEventAttributes.ActivityType.Name
+	return d.timedOut(dc, name, timeoutType, d.getStepControl(scheduled.ActivityTaskScheduledEventAttributes).Data)
+}
+
+// timedOut passes a timed out step to HandleTimeout if we have one, otherwise notifies the helpdesk
+func (d *Decider) timedOut(dc *DecisionContext, name string, timeoutType string, control string) error {
+	if d.HandleTimeout == nil {
+		return d.handleTimeout(dc, timeoutType)
+	}
+	Info.Printf("Activity %s timed out: %s\n", name, timeoutType)
+	next, err := d.HandleTimeout(d, dc, name, timeoutType, control)
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		return d.handleTimeout(dc, timeoutType)
+	}
+	if next.Complete {
+		return d.CompleteWorkflow(dc, next.Input)
+	}
+	return d.ScheduleActivity(dc, next)
+}
+
+// getScheduledEvent finds the ActivityTaskScheduled event by its event id
+func (d *Decider) getScheduledEvent(events []*swf.HistoryEvent, id int64) *swf.HistoryEvent {
+	for _, event := range events {
+		if *event.EventType == "ActivityTaskScheduled" && *event.EventId == id {
+			return event
+		}
+	}
+	return nil
+}
+
+// handleTimeout will send an email if the first timeout, then set marker so next time we dont email
+func (d *Decider) handleTimeout(dc *DecisionContext, timeoutType string) error {
+	to, _ := d.emailError(dc, "Activity "+timeoutType+" Timeout")
+	return d.respondDecisions(dc, []*swf.Decision{d.markerDecision("HelpdeskNotified", to)}, "Data")
+}
+
+func (d *Decider) emailError(dc *DecisionContext, reason string) (string, error) {
+	err := sendTemplate(d.cfg, d.Mailer, d.Templates, "workflowerror", "support@rapidtrade.biz", helpdesk, d.notificationData(dc, reason))
 	if err != nil {
 		return "", err
 	}
@@ -267,74 +561,153 @@ func (d *Decider) emailError(reason string) (string, error) {
 	return helpdesk, nil
 }
 
+// sendEmail sends through the Mailer if we have one, otherwise straight through SES
+func (d *Decider) sendEmail(from string, to string, subject string, message string) error {
+	if d.Mailer == nil {
+		return amazon.SESSendEmail(d.cfg, from, to, subject, message)
+	}
+	e := amazon.NewEmail(from, subject, to)
+	e.HTML = message
+	return d.Mailer.Send(e)
+}
+
+// consoleURL links to the workflow history in the SWF console
+func (d *Decider) consoleURL(dc *DecisionContext) string {
+	runid := strings.Replace(dc.runID, "=", "!=", 1)
+	return "https://console.aws.amazon.com/swf/home?region=" + d.cfg.GetRegion() + "#execution_events:domain=" + d.swfDomain + ";workflowId=" + dc.workflowID + ";runId=" + runid
+}
+
 // CompleteWorkflow will complete workflow
-func (d *Decider) CompleteWorkflow(result string) error {
-	params := &swf.RespondDecisionTaskCompletedInput{
-		TaskToken: aws.String(d.tt),
-		Decisions: []*swf.Decision{
-			{
-				DecisionType: aws.String("CompleteWorkflowExecution"),
-				CompleteWorkflowExecutionDecisionAttributes: &swf.CompleteWorkflowExecutionDecisionAttributes{
-					Result: aws.String(result),
-				},
-			},
+func (d *Decider) CompleteWorkflow(dc *DecisionContext, result string) error {
+	return d.respondDecisions(dc, []*swf.Decision{d.completeWorkflowDecision(result)}, "Data")
+}
+
+func (d *Decider) completeWorkflowDecision(result string) *swf.Decision {
+	return &swf.Decision{
+		DecisionType: aws.String("CompleteWorkflowExecution"),
+		CompleteWorkflowExecutionDecisionAttributes: &swf.CompleteWorkflowExecutionDecisionAttributes{
+			Result: aws.String(result),
 		},
-		ExecutionContext: aws.String("Data"),
 	}
-	_, err := d.svc.RespondDecisionTaskCompleted(params)
-	return err // which may be nil
 }
 
-// failWorkflow will fail this workflow
-func (d *Decider) failWorkflow(details string, err error) error {
+// failWorkflow will fail this workflow, keeping it in the dead letter store if we have one
+func (d *Decider) failWorkflow(dc *DecisionContext, details string, err error) error {
 	errorD := ""
 	if err != nil {
 		errorD = fmt.Sprintf("%v", err)
 	}
-	params := &swf.RespondDecisionTaskCompletedInput{
-		TaskToken: aws.String(d.tt),
-		Decisions: []*swf.Decision{
-			{
-				DecisionType: aws.String("FailWorkflowExecution"),
-				FailWorkflowExecutionDecisionAttributes: &swf.FailWorkflowExecutionDecisionAttributes{
-					Details: aws.String(details),
-					Reason:  aws.String(errorD),
-				},
-			},
+	d.deadLetter(dc, errorD, details, nil)
+	return d.respondDecisions(dc, []*swf.Decision{d.failWorkflowDecision(details, errorD)}, "Data")
+}
+
+func (d *Decider) failWorkflowDecision(details string, reason string) *swf.Decision {
+	return &swf.Decision{
+		DecisionType: aws.String("FailWorkflowExecution"),
+		FailWorkflowExecutionDecisionAttributes: &swf.FailWorkflowExecutionDecisionAttributes{
+			Details: aws.String(details),
+			Reason:  aws.String(reason),
 		},
-		ExecutionContext: aws.String("Data"),
 	}
-	_, err = d.svc.RespondDecisionTaskCompleted(params)
-	return err // which may be nil
 }
 
 // ScheduleNextActivity will start the next activity
-func (d *Decider) ScheduleNextActivity(name string, version string, input string, stcTimeout string, tasklist string, context string) error {
-	id := name + time.Now().Format("200601021504")
-	Info.Printf("Scheduling eventType: %s\n", name)
-	params := &swf.RespondDecisionTaskCompletedInput{
-		TaskToken: aws.String(d.tt),
-		Decisions: []*swf.Decision{
-			{
-				DecisionType: aws.String("ScheduleActivityTask"), //
-				ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{
-					ActivityId: aws.String(id),
-					ActivityType: &swf.ActivityType{
-						Name:    aws.String(name),
-						Version: aws.String(version),
-					},
-					Input:               aws.String(input),
-					StartToCloseTimeout: aws.String(stcTimeout),
-					TaskList: &swf.TaskList{
-						Name: aws.String(tasklist),
-					},
-				},
-			},
+func (d *Decider) ScheduleNextActivity(dc *DecisionContext, name string, version string, input string, stcTimeout string, tasklist string, context string) error {
+	return d.ScheduleActivity(dc, &NextActivity{
+		Name:       name,
+		Version:    version,
+		Input:      input,
+		StcTimeout: stcTimeout,
+		Tasklist:   tasklist,
+		Context:    context,
+	})
+}
+
+// ScheduleActivity will start the next activity with all its timeouts, priority, control and compensation,
+// or request its approval if it has one
+func (d *Decider) ScheduleActivity(dc *DecisionContext, next *NextActivity) error {
+	decisions, err := d.activityDecisions(dc, next)
+	if err != nil {
+		return err
+	}
+	return d.respondDecisions(dc, decisions, next.Context)
+}
+
+// nextDecisions returns the decisions for what handleDecision returned, completing the workflow if next.Complete is set
+func (d *Decider) nextDecisions(dc *DecisionContext, next *NextActivity) ([]*swf.Decision, error) {
+	if next.Complete {
+		return []*swf.Decision{d.completeWorkflowDecision(next.Input)}, nil
+	}
+	return d.activityDecisions(dc, next)
+}
+
+// respondNext responds with the given decisions plus those for next, which may be nil
+func (d *Decider) respondNext(dc *DecisionContext, decisions []*swf.Decision, next *NextActivity) error {
+	context := "Data"
+	if next != nil {
+		nextDecisions, err := d.nextDecisions(dc, next)
+		if err != nil {
+			return err
+		}
+		decisions = append(decisions, nextDecisions...)
+		if !next.Complete && next.Context != "" {
+			context = next.Context
+		}
+	}
+	return d.respondDecisions(dc, decisions, context)
+}
+
+func (d *Decider) activityDecisions(dc *DecisionContext, next *NextActivity) ([]*swf.Decision, error) {
+	if next.Approval != nil {
+		return d.approvalDecisions(dc, next)
+	}
+	if next.Lambda {
+		return []*swf.Decision{d.lambdaDecision(next)}, nil
+	}
+	id := next.Name + time.Now().Format("200601021504")
+	Info.Printf("Scheduling eventType: %s\n", next.Name)
+	var control *stepControl
+	if next.Compensation != nil || next.Control != "" {
+		control = &stepControl{Compensation: next.Compensation, Data: next.Control}
+	}
+	return []*swf.Decision{d.scheduleActivityDecision(id, next, control)}, nil
+}
+
+func (d *Decider) scheduleActivityDecision(id string, next *NextActivity, control *stepControl) *swf.Decision {
+	attrs := &swf.ScheduleActivityTaskDecisionAttributes{
+		ActivityId: aws.String(id),
+		ActivityType: &swf.ActivityType{
+			Name:    aws.String(next.Name),
+			Version: aws.String(next.Version),
+		},
+		Input: aws.String(next.Input),
+		TaskList: &swf.TaskList{
+			Name: aws.String(next.Tasklist),
 		},
-		ExecutionContext: aws.String(context),
 	}
-	_, err := d.svc.RespondDecisionTaskCompleted(params)
-	return err
+	if next.StcTimeout != "" {
+		attrs.StartToCloseTimeout = aws.String(next.StcTimeout)
+	}
+	if next.ScheduleToStartTimeout != "" {
+		attrs.ScheduleToStartTimeout = aws.String(next.ScheduleToStartTimeout)
+	}
+	if next.ScheduleToCloseTimeout != "" {
+		attrs.ScheduleToCloseTimeout = aws.String(next.ScheduleToCloseTimeout)
+	}
+	if next.HeartbeatTimeout != "" {
+		attrs.HeartbeatTimeout = aws.String(next.HeartbeatTimeout)
+	}
+	if next.TaskPriority != "" {
+		attrs.TaskPriority = aws.String(next.TaskPriority)
+	}
+	if control != nil {
+		b, _ := json.Marshal(control)
+		attrs.Control = aws.String(string(b))
+	}
+	return &swf.Decision{
+		DecisionType:                           aws.String("ScheduleActivityTask"),
+		ScheduleActivityTaskDecisionAttributes: attrs,
+	}
 }
 
 func (d *Decider) getJSON(input string) map[string]interface{} {
@@ -344,21 +717,49 @@ func (d *Decider) getJSON(input string) map[string]interface{} {
 	return m
 }
 
-func (d *Decider) handleWorkflowStart(event *swf.HistoryEvent) error {
+func (d *Decider) handleWorkflowStart(dc *DecisionContext, event *swf.HistoryEvent) error {
 	_ = "brakpoint"
 	wfInput := *event.WorkflowExecutionStartedEventAttributes.Input
-	err := d.ScheduleNextActivity(d.swfFirstActivity, d.swfFirstActivityVersion, wfInput, "10000", d.swfFirstTaskList, "")
-	return err
+	timers := d.slaTimerDecisions(dc)
+	// a re-driven workflow starts again from the step that failed
+	f, err := d.getRedrive(event)
+	if err != nil {
+		Error.Printf("error: %v\n", err)
+		return d.failWorkflow(dc, "", err)
+	}
+	if f != nil {
+		Info.Printf("Re-driving %s from %s", f.ID, f.FailedActivity)
+		first := d.getFirstActivity(f.FailedActivity, f.FailedActivityVersion, f.FailedActivityInput, f.FailedActivityTaskList)
+		if f.FailedLambda {
+			first.Lambda = true
+			first.StcTimeout = "" // the activity timeout is longer than Lambda allows, so use the SWF default
+		}
+		return d.respondNext(dc, timers, first)
+	}
+	return d.respondNext(dc, timers, d.getFirstActivity(d.swfFirstActivity, d.swfFirstActivityVersion, wfInput, d.swfFirstTaskList))
+}
+
+// getFirstActivity builds the activity a workflow starts with, using the FirstActivity timeouts if we have them
+func (d *Decider) getFirstActivity(name string, version string, input string, tasklist string) *NextActivity {
+	next := &NextActivity{StcTimeout: "10000"}
+	if d.FirstActivity != nil {
+		*next = *d.FirstActivity
+	}
+	next.Name = name
+	next.Version = version
+	next.Input = input
+	next.Tasklist = tasklist
+	return next
 }
 
 //======================================= handle routines ==================================================
 // handleLoadBigQueryComplete gets result JSON and starts loadcompleted using the supplierid as the tasklist
-func (d *Decider) handlePostorderComplete(jsonstr string) error {
+func (d *Decider) handlePostorderComplete(dc *DecisionContext, jsonstr string) error {
 	var rslt result
 	err := json.Unmarshal([]byte(jsonstr), &rslt)
 	if err != nil {
 		return err
 	}
-	err = d.ScheduleNextActivity("loadcompleted", "2", rslt.File, "10000", rslt.SupplierID, "")
+	err = d.ScheduleNextActivity(dc, "loadcompleted", "2", rslt.File, "10000", rslt.SupplierID, "")
 	return err
 }
@@ -0,0 +1,108 @@
+package workflow
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+func eventOfType(eventType string) *swf.HistoryEvent {
+	return &swf.HistoryEvent{EventType: aws.String(eventType)}
+}
+
+func cancelRequestedEvent(id string) *swf.HistoryEvent {
+	return &swf.HistoryEvent{
+		EventType: aws.String("ActivityTaskCancelRequested"),
+		ActivityTaskCancelRequestedEventAttributes: &swf.ActivityTaskCancelRequestedEventAttributes{ActivityId: aws.String(id)},
+	}
+}
+
+func cancelFailedEvent(id string) *swf.HistoryEvent {
+	return &swf.HistoryEvent{
+		EventType: aws.String("RequestCancelActivityTaskFailed"),
+		RequestCancelActivityTaskFailedEventAttributes: &swf.RequestCancelActivityTaskFailedEventAttributes{
+			ActivityId: aws.String(id),
+			Cause:      aws.String("ACTIVITY_ID_UNKNOWN"),
+		},
+	}
+}
+
+func TestCancelActivityDecisions(t *testing.T) {
+	tests := []struct {
+		name      string
+		events    []*swf.HistoryEvent
+		open      int
+		requests  []string
+		callbacks []string
+	}{
+		{"nothing open", history(scheduledEvent("load", "load", nil), completedEvent(1)), 0, nil, nil},
+		{"ask each open activity", history(
+			scheduledEvent("load", "load", nil), scheduledEvent("merge", "merge", nil),
+			eventOfType("WorkflowExecutionCancelRequested"),
+		), 2, []string{"merge", "load"}, nil},
+		{"already asked", history(
+			scheduledEvent("load", "load", nil), scheduledEvent("merge", "merge", nil),
+			eventOfType("DecisionTaskCompleted"), cancelRequestedEvent("merge"),
+		), 2, []string{"load"}, nil},
+		{"refused since the last decision", history(
+			scheduledEvent("load", "load", nil),
+			eventOfType("DecisionTaskCompleted"), cancelFailedEvent("load"),
+		), 1, nil, []string{"load"}},
+		{"refused before the last decision", history(
+			scheduledEvent("load", "load", nil),
+			eventOfType("DecisionTaskCompleted"), cancelFailedEvent("load"),
+			eventOfType("DecisionTaskCompleted"), eventOfType("WorkflowExecutionSignaled"),
+		), 1, nil, nil},
+	}
+	for _, tt := range tests {
+		var callbacks []string
+		d := &Decider{}
+		d.Events.RequestCancelActivityTaskFailed = func(d *Decider, dc *DecisionContext, attrs *swf.RequestCancelActivityTaskFailedEventAttributes) (*NextActivity, error) {
+			callbacks = append(callbacks, *attrs.ActivityId)
+			return nil, nil
+		}
+		open, decisions, err := d.cancelActivityDecisions(&DecisionContext{events: tt.events})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(open) != tt.open {
+			t.Errorf("%s: got %d open, want %d", tt.name, len(open), tt.open)
+		}
+		var requests []string
+		for _, decision := range decisions {
+			requests = append(requests, *decision.RequestCancelActivityTaskDecisionAttributes.ActivityId)
+		}
+		if !equalStrings(requests, tt.requests) {
+			t.Errorf("%s: got cancel requests %v, want %v", tt.name, requests, tt.requests)
+		}
+		if !equalStrings(callbacks, tt.callbacks) {
+			t.Errorf("%s: got callbacks for %v, want %v", tt.name, callbacks, tt.callbacks)
+		}
+	}
+}
+
+func TestCancelActivityDecisionsCallbackError(t *testing.T) {
+	d := &Decider{}
+	d.Events.RequestCancelActivityTaskFailed = func(d *Decider, dc *DecisionContext, attrs *swf.RequestCancelActivityTaskFailedEventAttributes) (*NextActivity, error) {
+		return nil, errors.New("stuck")
+	}
+	events := history(scheduledEvent("load", "load", nil), eventOfType("DecisionTaskCompleted"), cancelFailedEvent("load"))
+	if _, decisions, err := d.cancelActivityDecisions(&DecisionContext{events: events}); err == nil || decisions != nil {
+		t.Errorf("got %v, %v, want the callback error and no decisions", decisions, err)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package workflow
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// EventHandlers are optional typed callbacks for history events other than the activity events handled by handleDecision.
+// Return a NextActivity to schedule it (or complete the workflow if Complete is set), return nil to get the default
+// behaviour, or return an error to fail the workflow. The defaults are:
+//
+//	ScheduleActivityTaskFailed, StartTimerFailed and failed, timed out, cancelled or terminated child workflows fail the workflow
+//	ChildWorkflowExecutionCompleted is passed to handleDecision with the child workflow type as the last activity
+//	WorkflowExecutionSignaled (other than approval signals) and ChildWorkflowExecutionStarted are acknowledged with no decisions
+//	DecisionTaskTimedOut, MarkerRecorded and CompleteWorkflowExecutionFailed carry on to the event before, so the last decision is made again
+//
+// RequestCancelActivityTaskFailed only happens while open activities are being cancelled, after a cancel request or an
+// SLA escalation that terminates. By default the activity is left to close on its own, a NextActivity returned is ignored.
+type EventHandlers struct {
+	ScheduleActivityTaskFailed        func(d *Decider, dc *DecisionContext, attrs *swf.ScheduleActivityTaskFailedEventAttributes) (*NextActivity, error)
+	StartTimerFailed                  func(d *Decider, dc *DecisionContext, attrs *swf.StartTimerFailedEventAttributes) (*NextActivity, error)
+	DecisionTaskTimedOut              func(d *Decider, dc *DecisionContext, attrs *swf.DecisionTaskTimedOutEventAttributes) (*NextActivity, error)
+	WorkflowExecutionSignaled         func(d *Decider, dc *DecisionContext, attrs *swf.WorkflowExecutionSignaledEventAttributes) (*NextActivity, error)
+	MarkerRecorded                    func(d *Decider, dc *DecisionContext, attrs *swf.MarkerRecordedEventAttributes) (*NextActivity, error)
+	RequestCancelActivityTaskFailed   func(d *Decider, dc *DecisionContext, attrs *swf.RequestCancelActivityTaskFailedEventAttributes) (*NextActivity, error)
+	StartChildWorkflowExecutionFailed func(d *Decider, dc *DecisionContext, attrs *swf.StartChildWorkflowExecutionFailedEventAttributes) (*NextActivity, error)
+	ChildWorkflowExecutionStarted     func(d *Decider, dc *DecisionContext, attrs *swf.ChildWorkflowExecutionStartedEventAttributes) (*NextActivity, error)
+	ChildWorkflowExecutionCompleted   func(d *Decider, dc *DecisionContext, attrs *swf.ChildWorkflowExecutionCompletedEventAttributes) (*NextActivity, error)
+	ChildWorkflowExecutionFailed      func(d *Decider, dc *DecisionContext, attrs *swf.ChildWorkflowExecutionFailedEventAttributes) (*NextActivity, error)
+	ChildWorkflowExecutionTimedOut    func(d *Decider, dc *DecisionContext, attrs *swf.ChildWorkflowExecutionTimedOutEventAttributes) (*NextActivity, error)
+	ChildWorkflowExecutionCanceled    func(d *Decider, dc *DecisionContext, attrs *swf.ChildWorkflowExecutionCanceledEventAttributes) (*NextActivity, error)
+	ChildWorkflowExecutionTerminated  func(d *Decider, dc *DecisionContext, attrs *swf.ChildWorkflowExecutionTerminatedEventAttributes) (*NextActivity, error)
+	CompleteWorkflowExecutionFailed   func(d *Decider, dc *DecisionContext, attrs *swf.CompleteWorkflowExecutionFailedEventAttributes) (*NextActivity, error)
+}
+
+// default behaviours when there is no callback, or it returns nil
+const (
+	eventFail = iota
+	eventAcknowledge
+	eventContinue
+	eventDecide
+)
+
+// handleEvent calls the callback for an event, if we have one, and falls back to the default.
+// It returns true if a decision was made so we can stop scanning events.
+func (d *Decider) handleEvent(dc *DecisionContext, event *swf.HistoryEvent, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error)) (bool, error) {
+	var next *NextActivity
+	var err error
+	var reason string
+	fallback := eventFail
+	h := d.Events
+
+	switch *event.EventType {
+	case "ScheduleActivityTaskFailed":
+		attrs := event.ScheduleActivityTaskFailedEventAttributes
+		reason = "Unable to schedule " + *attrs.ActivityType.Name + ": " + *attrs.Cause
+		if h.ScheduleActivityTaskFailed != nil {
+			next, err = h.ScheduleActivityTaskFailed(d, dc, attrs)
+		}
+	case "StartTimerFailed":
+		attrs := event.StartTimerFailedEventAttributes
+		reason = "Unable to start timer " + *attrs.TimerId + ": " + *attrs.Cause
+		if h.StartTimerFailed != nil {
+			next, err = h.StartTimerFailed(d, dc, attrs)
+		}
+	case "DecisionTaskTimedOut":
+		attrs := event.DecisionTaskTimedOutEventAttributes
+		Info.Printf("Decision task timed out: %s\n", *attrs.TimeoutType)
+		fallback = eventContinue
+		if h.DecisionTaskTimedOut != nil {
+			next, err = h.DecisionTaskTimedOut(d, dc, attrs)
+		}
+	case "WorkflowExecutionSignaled":
+		attrs := event.WorkflowExecutionSignaledEventAttributes
+		Info.Printf("Workflow signaled: %s\n", *attrs.SignalName)
+		fallback = eventAcknowledge
+		if h.WorkflowExecutionSignaled != nil {
+			next, err = h.WorkflowExecutionSignaled(d, dc, attrs)
+		}
+	case "MarkerRecorded":
+		attrs := event.MarkerRecordedEventAttributes
+		fallback = eventContinue
+		if h.MarkerRecorded != nil {
+			next, err = h.MarkerRecorded(d, dc, attrs)
+		}
+	case "StartChildWorkflowExecutionFailed":
+		attrs := event.StartChildWorkflowExecutionFailedEventAttributes
+		reason = "Unable to start child workflow " + *attrs.WorkflowType.Name + ": " + *attrs.Cause
+		if h.StartChildWorkflowExecutionFailed != nil {
+			next, err = h.StartChildWorkflowExecutionFailed(d, dc, attrs)
+		}
+	case "ChildWorkflowExecutionStarted":
+		attrs := event.ChildWorkflowExecutionStartedEventAttributes
+		fallback = eventAcknowledge
+		if h.ChildWorkflowExecutionStarted != nil {
+			next, err = h.ChildWorkflowExecutionStarted(d, dc, attrs)
+		}
+	case "ChildWorkflowExecutionCompleted":
+		attrs := event.ChildWorkflowExecutionCompletedEventAttributes
+		fallback = eventDecide
+		if h.ChildWorkflowExecutionCompleted != nil {
+			next, err = h.ChildWorkflowExecutionCompleted(d, dc, attrs)
+		} else {
+			next, err = handleDecision(d, dc, *attrs.WorkflowType.Name, aws.StringValue(attrs.Result))
+		}
+	case "ChildWorkflowExecutionFailed":
+		attrs := event.ChildWorkflowExecutionFailedEventAttributes
+		reason = "Child workflow " + *attrs.WorkflowType.Name + " failed: " + aws.StringValue(attrs.Reason)
+		if h.ChildWorkflowExecutionFailed != nil {
+			next, err = h.ChildWorkflowExecutionFailed(d, dc, attrs)
+		}
+	case "ChildWorkflowExecutionTimedOut":
+		attrs := event.ChildWorkflowExecutionTimedOutEventAttributes
+		reason = "Child workflow " + *attrs.WorkflowType.Name + " timed out"
+		if h.ChildWorkflowExecutionTimedOut != nil {
+			next, err = h.ChildWorkflowExecutionTimedOut(d, dc, attrs)
+		}
+	case "ChildWorkflowExecutionCanceled":
+		attrs := event.ChildWorkflowExecutionCanceledEventAttributes
+		reason = "Child workflow " + *attrs.WorkflowType.Name + " cancelled"
+		if h.ChildWorkflowExecutionCanceled != nil {
+			next, err = h.ChildWorkflowExecutionCanceled(d, dc, attrs)
+		}
+	case "ChildWorkflowExecutionTerminated":
+		attrs := event.ChildWorkflowExecutionTerminatedEventAttributes
+		reason = "Child workflow " + *attrs.WorkflowType.Name + " terminated"
+		if h.ChildWorkflowExecutionTerminated != nil {
+			next, err = h.ChildWorkflowExecutionTerminated(d, dc, attrs)
+		}
+	case "CompleteWorkflowExecutionFailed":
+		attrs := event.CompleteWorkflowExecutionFailedEventAttributes
+		Info.Printf("Unable to complete workflow: %s, deciding again\n", *attrs.Cause)
+		fallback = eventContinue
+		if h.CompleteWorkflowExecutionFailed != nil {
+			next, err = h.CompleteWorkflowExecutionFailed(d, dc, attrs)
+		}
+	default:
+		return false, nil
+	}
+
+	if err != nil {
+		return true, err
+	}
+	if next != nil {
+		if next.Complete {
+			err = d.CompleteWorkflow(dc, next.Input)
+		} else {
+			err = d.ScheduleActivity(dc, next)
+		}
+		if err != nil {
+			Error.Printf("error: unable to respond to %s: %v\n", *event.EventType, err)
+		}
+		return true, nil
+	}
+
+	switch fallback {
+	case eventFail:
+		Info.Println(reason)
+		d.emailError(dc, *event.EventType)
+		if err = d.failWithCompensation(dc, reason, errors.New(*event.EventType)); err != nil {
+			Error.Printf("error: unable to fail workflow: %v\n", err)
+		}
+		return true, nil
+	case eventAcknowledge, eventDecide:
+		// eventDecide only gets here if handleDecision returned nil, so there is nothing to schedule
+		if err = d.respondDecisions(dc, nil, "Data"); err != nil {
+			Error.Printf("error: unable to respond to %s: %v\n", *event.EventType, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,197 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Health tracks the poll loop of a decider or activity worker, so an orchestrator can tell if it is stuck.
+// Set it on Decider, Activity or ActivityPoller and call ListenAndServe to expose:
+//
+//	/healthz  liveness, fails if the poll loop has not gone round within MaxLoopAge and no task is in flight
+//	/readyz   readiness, fails if there has not been a successful poll within MaxPollAge
+//	/status   JSON status including the tasks in flight and their age
+type Health struct {
+	Name       string
+	MaxLoopAge time.Duration
+	MaxPollAge time.Duration
+
+	mu        sync.Mutex
+	started   time.Time
+	lastLoop  time.Time
+	lastPoll  time.Time
+	lastError string
+	seq       int
+	inflight  map[int]*inflightTask
+}
+
+type inflightTask struct {
+	Name       string
+	TaskList   string
+	WorkflowID string
+	Started    time.Time
+}
+
+// healthStatus is what /status returns
+type healthStatus struct {
+	Name        string
+	Started     time.Time
+	LastLoop    time.Time
+	LastLoopAge string
+	LastPoll    time.Time
+	LastPollAge string
+	LastError   string `json:",omitempty"`
+	Live        bool
+	Ready       bool
+	InFlight    []inflightStatus
+}
+
+type inflightStatus struct {
+	Name       string
+	TaskList   string
+	WorkflowID string
+	Started    time.Time
+	Age        string
+}
+
+// NewHealth sets up the struc, a long poll takes up to 60 seconds so the defaults allow for a few of those
+func NewHealth(name string) *Health {
+	h := &Health{
+		Name:       name,
+		MaxLoopAge: 3 * time.Minute,
+		MaxPollAge: 5 * time.Minute,
+		started:    time.Now(),
+		inflight:   make(map[int]*inflightTask),
+	}
+	return h
+}
+
+// ListenAndServe starts the embedded HTTP server in the background, eg. h.ListenAndServe(":8080")
+func (h *Health) ListenAndServe(addr string) {
+	go func() {
+		if err := http.ListenAndServe(addr, h.Handler()); err != nil {
+			Error.Printf("error: health server stopped: %v\n", err)
+		}
+	}()
+}
+
+// Handler returns the health endpoints, so they can be mounted on an existing server
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s := h.status()
+		writeCheck(w, s.Live, "poll loop last ran "+s.LastLoopAge+" ago")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s := h.status()
+		writeCheck(w, s.Ready, "last successful poll "+s.LastPollAge+" ago")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(h.status(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	return mux
+}
+
+func writeCheck(w http.ResponseWriter, ok bool, msg string) {
+	if !ok {
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, msg)
+}
+
+// beat is called each time round the poll loop
+func (h *Health) beat() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.lastLoop = time.Now()
+	h.mu.Unlock()
+}
+
+// polled records the outcome of a poll
+func (h *Health) polled(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastLoop = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+		return
+	}
+	h.lastPoll = h.lastLoop
+	h.lastError = ""
+}
+
+// taskStarted records a task in flight, call the returned func when it is finished
+func (h *Health) taskStarted(name string, tasklist string, workflowID string) func() {
+	if h == nil {
+		return func() {}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	id := h.seq
+	h.inflight[id] = &inflightTask{Name: name, TaskList: tasklist, WorkflowID: workflowID, Started: time.Now()}
+	return func() {
+		h.mu.Lock()
+		delete(h.inflight, id)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Health) status() *healthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	// the loop waits for a free worker before polling again, so it is not stuck while tasks are running
+	s := &healthStatus{
+		Name:        h.Name,
+		Started:     h.started,
+		LastLoop:    h.lastLoop,
+		LastLoopAge: age(now, h.lastLoop),
+		LastPoll:    h.lastPoll,
+		LastPollAge: age(now, h.lastPoll),
+		LastError:   h.lastError,
+		Live:        len(h.inflight) > 0 || (!h.lastLoop.IsZero() && now.Sub(h.lastLoop) < h.MaxLoopAge),
+		Ready:       !h.lastPoll.IsZero() && now.Sub(h.lastPoll) < h.MaxPollAge,
+	}
+	var ids []int
+	for id := range h.inflight {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		t := h.inflight[id]
+		s.InFlight = append(s.InFlight, inflightStatus{
+			Name:       t.Name,
+			TaskList:   t.TaskList,
+			WorkflowID: t.WorkflowID,
+			Started:    t.Started,
+			Age:        age(now, t.Started),
+		})
+	}
+	return s
+}
+
+// age formats how long ago t was, rounded to the second
+func age(now time.Time, t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return strconv.Itoa(int(now.Sub(t).Seconds())) + "s"
+}
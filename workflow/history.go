@@ -0,0 +1,383 @@
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// GetHistory gets the whole history of a workflow execution, oldest event first
+func GetHistory(cfg *amazon.Config, domain string, workflowID string, runID string) ([]*swf.HistoryEvent, error) {
+	svc, err := amazon.SWFNewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var events []*swf.HistoryEvent
+	params := &swf.GetWorkflowExecutionHistoryInput{
+		Domain: aws.String(domain),
+		Execution: &swf.WorkflowExecution{
+			WorkflowId: aws.String(workflowID),
+			RunId:      aws.String(runID),
+		},
+		MaximumPageSize: aws.Int64(1000),
+	}
+	err = svc.GetWorkflowExecutionHistoryPages(params, func(page *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) bool {
+		events = append(events, page.Events...)
+		return true
+	})
+	return events, err
+}
+
+// SaveHistory writes the history to a JSON file that LoadHistory can read back
+func SaveHistory(fileName string, events []*swf.HistoryEvent) error {
+	b, err := json.MarshalIndent(map[string]interface{}{"events": events}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, b, 0666)
+}
+
+// LoadHistory reads a history JSON file, as written by SaveHistory or exported with
+// aws swf get-workflow-execution-history. Events are returned oldest first.
+func LoadHistory(fileName string) ([]*swf.HistoryEvent, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Events []map[string]interface{} `json:"events"`
+	}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	var events []*swf.HistoryEvent
+	for _, raw := range doc.Events {
+		// the CLI exports timestamps as epoch seconds
+		for k, v := range raw {
+			if secs, ok := v.(float64); ok && strings.EqualFold(k, "eventTimestamp") {
+				raw[k] = time.Unix(0, int64(secs*float64(time.Second))).Format(time.RFC3339Nano)
+			}
+		}
+		eb, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		event := &swf.HistoryEvent{}
+		if err = json.Unmarshal(eb, event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return *events[i].EventId < *events[j].EventId })
+	return events, nil
+}
+
+// historyItem is one bar on the timeline or node on the graph, eg. an activity from scheduled to closed
+type historyItem struct {
+	ID        int64 // event id that opened the item
+	Kind      string
+	Name      string
+	Outcome   string
+	Detail    string
+	Scheduled time.Time
+	Started   time.Time
+	Closed    time.Time
+	Causes    []int64 // items that closed before the decision that opened this item
+}
+
+// buildTimeline turns the events into items in the order they were opened
+func buildTimeline(events []*swf.HistoryEvent) []*historyItem {
+	events = append([]*swf.HistoryEvent(nil), events...)
+	sort.Slice(events, func(i, j int) bool { return *events[i].EventId < *events[j].EventId })
+
+	var items []*historyItem
+	byEvent := make(map[int64]*historyItem)
+	causesByDecision := make(map[int64][]int64)
+	var pending []int64
+
+	open := func(event *swf.HistoryEvent, kind string, name string, decisionID *int64) *historyItem {
+		item := &historyItem{ID: *event.EventId, Kind: kind, Name: name, Scheduled: *event.EventTimestamp}
+		if decisionID != nil {
+			item.Causes = causesByDecision[*decisionID]
+		}
+		items = append(items, item)
+		byEvent[item.ID] = item
+		return item
+	}
+	closeItem := func(event *swf.HistoryEvent, id *int64, outcome string, detail *string) {
+		item, ok := byEvent[aws.Int64Value(id)]
+		if !ok {
+			return
+		}
+		item.Closed = *event.EventTimestamp
+		item.Outcome = outcome
+		item.Detail = aws.StringValue(detail)
+		pending = append(pending, item.ID)
+	}
+	instant := func(event *swf.HistoryEvent, kind string, name string, outcome string, detail *string, decisionID *int64) {
+		item := open(event, kind, name, decisionID)
+		item.Closed = item.Scheduled
+		item.Outcome = outcome
+		item.Detail = aws.StringValue(detail)
+		pending = append(pending, item.ID)
+	}
+
+	for _, event := range events {
+		switch *event.EventType {
+		case "WorkflowExecutionStarted":
+			attrs := event.WorkflowExecutionStartedEventAttributes
+			instant(event, "workflow", *attrs.WorkflowType.Name, "started", attrs.Input, nil)
+		case "DecisionTaskCompleted":
+			causesByDecision[*event.EventId] = pending
+			pending = nil
+
+		case "ActivityTaskScheduled":
+			attrs := event.ActivityTaskScheduledEventAttributes
+			item := open(event, "activity", *attrs.ActivityType.Name, attrs.DecisionTaskCompletedEventId)
+			item.Outcome = "scheduled"
+		case "ActivityTaskStarted":
+			if item, ok := byEvent[*event.ActivityTaskStartedEventAttributes.ScheduledEventId]; ok {
+				item.Started = *event.EventTimestamp
+				item.Outcome = "started"
+			}
+		case "ActivityTaskCompleted":
+			attrs := event.ActivityTaskCompletedEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "completed", attrs.Result)
+		case "ActivityTaskFailed":
+			attrs := event.ActivityTaskFailedEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "failed", attrs.Reason)
+		case "ActivityTaskTimedOut":
+			attrs := event.ActivityTaskTimedOutEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "timedout", attrs.TimeoutType)
+		case "ActivityTaskCanceled":
+			attrs := event.ActivityTaskCanceledEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "canceled", attrs.Details)
+		case "ScheduleActivityTaskFailed":
+			attrs := event.ScheduleActivityTaskFailedEventAttributes
+			instant(event, "activity", *attrs.ActivityType.Name, "failed", attrs.Cause, attrs.DecisionTaskCompletedEventId)
+
+		case "LambdaFunctionScheduled":
+			attrs := event.LambdaFunctionScheduledEventAttributes
+			item := open(event, "lambda", *attrs.Name, attrs.DecisionTaskCompletedEventId)
+			item.Outcome = "scheduled"
+		case "LambdaFunctionStarted":
+			if item, ok := byEvent[*event.LambdaFunctionStartedEventAttributes.ScheduledEventId]; ok {
+				item.Started = *event.EventTimestamp
+				item.Outcome = "started"
+			}
+		case "LambdaFunctionCompleted":
+			attrs := event.LambdaFunctionCompletedEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "completed", attrs.Result)
+		case "LambdaFunctionFailed":
+			attrs := event.LambdaFunctionFailedEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "failed", attrs.Reason)
+		case "LambdaFunctionTimedOut":
+			attrs := event.LambdaFunctionTimedOutEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "timedout", attrs.TimeoutType)
+		case "StartLambdaFunctionFailed":
+			attrs := event.StartLambdaFunctionFailedEventAttributes
+			closeItem(event, attrs.ScheduledEventId, "failed", attrs.Message)
+		case "ScheduleLambdaFunctionFailed":
+			attrs := event.ScheduleLambdaFunctionFailedEventAttributes
+			instant(event, "lambda", *attrs.Name, "failed", attrs.Cause, attrs.DecisionTaskCompletedEventId)
+
+		case "TimerStarted":
+			attrs := event.TimerStartedEventAttributes
+			item := open(event, "timer", *attrs.TimerId, attrs.DecisionTaskCompletedEventId)
+			item.Started = item.Scheduled
+			item.Outcome = "started"
+		case "TimerFired":
+			attrs := event.TimerFiredEventAttributes
+			closeItem(event, attrs.StartedEventId, "fired", nil)
+		case "TimerCanceled":
+			attrs := event.TimerCanceledEventAttributes
+			closeItem(event, attrs.StartedEventId, "canceled", nil)
+		case "StartTimerFailed":
+			attrs := event.StartTimerFailedEventAttributes
+			instant(event, "timer", *attrs.TimerId, "failed", attrs.Cause, attrs.DecisionTaskCompletedEventId)
+
+		case "MarkerRecorded":
+			attrs := event.MarkerRecordedEventAttributes
+			instant(event, "marker", *attrs.MarkerName, "recorded", attrs.Details, attrs.DecisionTaskCompletedEventId)
+		case "WorkflowExecutionSignaled":
+			attrs := event.WorkflowExecutionSignaledEventAttributes
+			instant(event, "signal", *attrs.SignalName, "received", attrs.Input, nil)
+
+		case "WorkflowExecutionCompleted":
+			attrs := event.WorkflowExecutionCompletedEventAttributes
+			instant(event, "workflow", "close", "completed", attrs.Result, attrs.DecisionTaskCompletedEventId)
+		case "WorkflowExecutionFailed":
+			attrs := event.WorkflowExecutionFailedEventAttributes
+			instant(event, "workflow", "close", "failed", attrs.Reason, attrs.DecisionTaskCompletedEventId)
+		case "WorkflowExecutionCanceled":
+			attrs := event.WorkflowExecutionCanceledEventAttributes
+			instant(event, "workflow", "close", "canceled", attrs.Details, attrs.DecisionTaskCompletedEventId)
+		case "WorkflowExecutionTimedOut":
+			attrs := event.WorkflowExecutionTimedOutEventAttributes
+			instant(event, "workflow", "close", "timedout", attrs.TimeoutType, nil)
+		case "WorkflowExecutionTerminated":
+			attrs := event.WorkflowExecutionTerminatedEventAttributes
+			instant(event, "workflow", "close", "terminated", attrs.Reason, nil)
+		}
+	}
+	return items
+}
+
+// outcomeColour is the colour used for an outcome in both the graph and the timeline
+func outcomeColour(outcome string) string {
+	switch outcome {
+	case "completed", "fired", "received", "recorded":
+		return "#5cb85c"
+	case "failed", "timedout", "terminated":
+		return "#d9534f"
+	case "canceled":
+		return "#f0ad4e"
+	}
+	return "#5bc0de"
+}
+
+// HistoryToDOT renders the history as a Graphviz DOT graph, eg. dot -Tsvg history.dot > history.svg
+// Each activity, timer, marker and signal is a node, with edges from what closed to what the next decision opened.
+func HistoryToDOT(events []*swf.HistoryEvent) string {
+	shapes := map[string]string{"workflow": "doublecircle", "activity": "box", "timer": "ellipse", "marker": "note", "signal": "cds", "lambda": "component"}
+	var b bytes.Buffer
+	b.WriteString("digraph workflow {\n\trankdir=LR;\n\tnode [style=filled, fontname=Helvetica];\n")
+	for _, item := range buildTimeline(events) {
+		label := dotEscape(item.Name) + "\\n" + item.Outcome
+		if !item.Closed.IsZero() && item.Closed.After(item.Scheduled) {
+			label += "\\n" + item.Closed.Sub(item.Scheduled).String()
+		}
+		if item.Detail != "" && item.Outcome != "completed" && item.Kind != "workflow" {
+			label += "\\n" + dotEscape(truncate(item.Detail, 40))
+		}
+		fmt.Fprintf(&b, "\te%d [label=\"%s\", shape=%s, fillcolor=\"%s\"];\n", item.ID, label, shapes[item.Kind], outcomeColour(item.Outcome))
+		for _, cause := range item.Causes {
+			fmt.Fprintf(&b, "\te%d -> e%d;\n", cause, item.ID)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotEscape(s string) string {
+	return strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "\"", "\\\"", -1)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// timelineRow is an item laid out on the HTML timeline, positions are percentages of the whole workflow
+type timelineRow struct {
+	*historyItem
+	Left    float64
+	Queued  float64
+	Running float64
+	Width   float64
+	Colour  string
+	Title   string
+}
+
+var timelineTemplate = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 13px; margin: 20px; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 3px 6px; border-bottom: 1px solid #eee; white-space: nowrap; }
+td.track { width: 70%; position: relative; }
+.bar { position: absolute; top: 4px; height: 14px; min-width: 2px; }
+.queued { position: absolute; top: 4px; height: 14px; background: #ddd; }
+.kind { color: #888; }
+</style>
+</head>
+<body>
+<h2>{{.Title}}</h2>
+<p>{{.Start.Format "2006-01-02 15:04:05"}} to {{.End.Format "2006-01-02 15:04:05"}} ({{.Duration}})</p>
+<table>
+{{range .Rows}}<tr title="{{.Title}}">
+<td class="kind">{{.Kind}}</td><td>{{.Name}}</td><td>{{.Outcome}}</td>
+<td class="track"><div class="queued" style="left:{{printf "%.2f" .Left}}%;width:{{printf "%.2f" .Queued}}%"></div><div class="bar" style="left:{{printf "%.2f" .Running}}%;width:{{printf "%.2f" .Width}}%;background:{{.Colour}}"></div></td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// HistoryToHTML renders the history as a self contained HTML timeline, with activities as bars from scheduled
+// (grey while waiting to start) to closed, and timers, markers, signals and failures along side them
+func HistoryToHTML(title string, events []*swf.HistoryEvent) (string, error) {
+	items := buildTimeline(events)
+	if len(items) == 0 {
+		return "", fmt.Errorf("No events to render")
+	}
+	start := items[0].Scheduled
+	end := start
+	for _, item := range items {
+		if item.Closed.After(end) {
+			end = item.Closed
+		}
+		if item.Started.After(end) {
+			end = item.Started
+		}
+	}
+	total := end.Sub(start).Seconds()
+	if total <= 0 {
+		total = 1
+	}
+	pct := func(t time.Time) float64 {
+		return t.Sub(start).Seconds() / total * 100
+	}
+
+	var rows []*timelineRow
+	for _, item := range items {
+		closed := item.Closed
+		if closed.IsZero() {
+			closed = end // still running
+		}
+		started := item.Started
+		if started.IsZero() {
+			started = closed
+		}
+		row := &timelineRow{historyItem: item, Colour: outcomeColour(item.Outcome)}
+		row.Left = pct(item.Scheduled)
+		row.Queued = pct(started) - row.Left
+		row.Running = pct(started)
+		row.Width = pct(closed) - row.Running
+		row.Title = fmt.Sprintf("scheduled %s", item.Scheduled.Format("15:04:05"))
+		if !item.Started.IsZero() {
+			row.Title += fmt.Sprintf(", started %s", item.Started.Format("15:04:05"))
+		}
+		if !item.Closed.IsZero() {
+			row.Title += fmt.Sprintf(", closed %s", item.Closed.Format("15:04:05"))
+		}
+		if item.Detail != "" {
+			row.Title += "\n" + truncate(item.Detail, 500)
+		}
+		rows = append(rows, row)
+	}
+
+	var b bytes.Buffer
+	err := timelineTemplate.Execute(&b, map[string]interface{}{
+		"Title":    title,
+		"Start":    start,
+		"End":      end,
+		"Duration": end.Sub(start).String(),
+		"Rows":     rows,
+	})
+	return b.String(), err
+}
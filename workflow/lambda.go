@@ -0,0 +1,213 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+	"golang.org/x/net/context"
+)
+
+// defaultLambdaTimeout is what SWF uses when a Lambda task has no start to close timeout, in seconds
+const defaultLambdaTimeout = 300
+
+// lambdaName is the function name without any ARN prefix
+func lambdaName(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// lambdaDecision schedules a Lambda function, the id is the function name without any ARN prefix
+func (d *Decider) lambdaDecision(next *NextActivity) *swf.Decision {
+	id := lambdaName(next.Name) + time.Now().Format("200601021504")
+	Info.Printf("Scheduling lambda: %s\n", next.Name)
+	attrs := &swf.ScheduleLambdaFunctionDecisionAttributes{
+		Id:    aws.String(id),
+		Name:  aws.String(next.Name),
+		Input: aws.String(next.Input),
+	}
+	if next.StcTimeout != "" {
+		attrs.StartToCloseTimeout = aws.String(next.StcTimeout)
+	}
+	if next.Control != "" {
+		b, _ := json.Marshal(&stepControl{Data: next.Control})
+		attrs.Control = aws.String(string(b))
+	}
+	return &swf.Decision{
+		DecisionType:                             aws.String("ScheduleLambdaFunction"),
+		ScheduleLambdaFunctionDecisionAttributes: attrs,
+	}
+}
+
+// getLambdaScheduled finds the LambdaFunctionScheduled event by its event id
+func (d *Decider) getLambdaScheduled(events []*swf.HistoryEvent, id int64) *swf.LambdaFunctionScheduledEventAttributes {
+	for _, event := range events {
+		if *event.EventType == "LambdaFunctionScheduled" && *event.EventId == id {
+			return event.LambdaFunctionScheduledEventAttributes
+		}
+	}
+	return nil
+}
+
+// handleLambdaCompleted passes the result to handleDecision with the function name as the last activity
+func (d *Decider) handleLambdaCompleted(dc *DecisionContext, event *swf.HistoryEvent, handleDecision func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error)) error {
+	attrs := event.LambdaFunctionCompletedEventAttributes
+	scheduled := d.getLambdaScheduled(dc.events, *attrs.ScheduledEventId)
+	if scheduled == nil {
+		return errors.New("lambda completed but its scheduled event is missing")
+	}
+	next, err := handleDecision(d, dc, *scheduled.Name, aws.StringValue(attrs.Result))
+	if err != nil {
+		d.emailError(dc, "LambdaFunctionFailed")
+		if err = d.failWithCompensation(dc, err.Error(), nil); err != nil {
+			Error.Printf("error: unable to fail workflow: %v\n", err)
+		}
+		return nil
+	}
+	return d.respondNext(dc, nil, next)
+}
+
+// handleLambdaTimedOut passes the timeout to HandleTimeout in the same way as an activity timeout
+func (d *Decider) handleLambdaTimedOut(dc *DecisionContext, event *swf.HistoryEvent) error {
+	attrs := event.LambdaFunctionTimedOutEventAttributes
+	timeoutType := aws.StringValue(attrs.TimeoutType)
+	scheduled := d.getLambdaScheduled(dc.events, *attrs.ScheduledEventId)
+	if scheduled == nil {
+		return d.handleTimeout(dc, timeoutType)
+	}
+	return d.timedOut(dc, *scheduled.Name, timeoutType, d.parseStepControl(scheduled.Control).Data)
+}
+
+// handleLambdaFailed fails the workflow when a Lambda function fails or could not be scheduled or started
+func (d *Decider) handleLambdaFailed(dc *DecisionContext, event *swf.HistoryEvent) {
+	var reason string
+	switch *event.EventType {
+	case "LambdaFunctionFailed":
+		attrs := event.LambdaFunctionFailedEventAttributes
+		reason = aws.StringValue(attrs.Reason)
+		if attrs.Details != nil {
+			reason += ": " + *attrs.Details
+		}
+	case "ScheduleLambdaFunctionFailed":
+		attrs := event.ScheduleLambdaFunctionFailedEventAttributes
+		reason = "Unable to schedule lambda " + *attrs.Name + ": " + *attrs.Cause
+	case "StartLambdaFunctionFailed":
+		attrs := event.StartLambdaFunctionFailedEventAttributes
+		reason = "Unable to start lambda: " + aws.StringValue(attrs.Cause) + " " + aws.StringValue(attrs.Message)
+	}
+	Info.Println(reason)
+	d.emailError(dc, *event.EventType)
+	if err := d.failWithCompensation(dc, reason, errors.New(*event.EventType)); err != nil {
+		Error.Printf("error: unable to fail workflow: %v\n", err)
+	}
+}
+
+// LocalLambdas stands in for Lambda when testing decision logic, running Go functions in place of the
+// Lambda functions a decider schedules. Scheduled and Run give the events SWF would record, so a history
+// can be built to drive the decider, or Result gives just the outcome, eg.
+//
+//	local := &workflow.LocalLambdas{Functions: map[string]func(ctx context.Context, input string) (string, error){
+//		"resizeimages": resizeImages,
+//	}}
+//	result, err := local.Result(next)
+//	next, err = handleDecision(d, dc, next.Name, result)
+type LocalLambdas struct {
+	Functions map[string]func(ctx context.Context, input string) (string, error)
+}
+
+// Scheduled returns the LambdaFunctionScheduled event SWF records for a Lambda step, with the given event id
+func (l *LocalLambdas) Scheduled(next *NextActivity, eventID int64) *swf.HistoryEvent {
+	attrs := &swf.LambdaFunctionScheduledEventAttributes{
+		Id:    aws.String(lambdaName(next.Name)),
+		Name:  aws.String(next.Name),
+		Input: aws.String(next.Input),
+	}
+	if next.StcTimeout != "" {
+		attrs.StartToCloseTimeout = aws.String(next.StcTimeout)
+	}
+	if next.Control != "" {
+		b, _ := json.Marshal(&stepControl{Data: next.Control})
+		attrs.Control = aws.String(string(b))
+	}
+	return &swf.HistoryEvent{
+		EventId:                                aws.Int64(eventID),
+		EventTimestamp:                         aws.Time(time.Now()),
+		EventType:                              aws.String("LambdaFunctionScheduled"),
+		LambdaFunctionScheduledEventAttributes: attrs,
+	}
+}
+
+// Run runs the function for a Lambda step, with its start to close timeout, and returns the LambdaFunctionCompleted,
+// LambdaFunctionFailed or LambdaFunctionTimedOut event for the LambdaFunctionScheduled event with scheduledEventID
+func (l *LocalLambdas) Run(next *NextActivity, scheduledEventID int64) *swf.HistoryEvent {
+	event := &swf.HistoryEvent{EventId: aws.Int64(scheduledEventID + 1), EventTimestamp: aws.Time(time.Now())}
+	fn, ok := l.Functions[next.Name]
+	if !ok {
+		event.EventType = aws.String("LambdaFunctionFailed")
+		event.LambdaFunctionFailedEventAttributes = &swf.LambdaFunctionFailedEventAttributes{
+			ScheduledEventId: aws.Int64(scheduledEventID),
+			Reason:           aws.String("Function not found: " + next.Name),
+		}
+		return event
+	}
+
+	timeout := defaultLambdaTimeout
+	if sec, err := strconv.Atoi(next.StcTimeout); err == nil {
+		timeout = sec
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	type outcome struct {
+		result string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := fn(ctx, next.Input)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		if o.err != nil {
+			event.EventType = aws.String("LambdaFunctionFailed")
+			event.LambdaFunctionFailedEventAttributes = &swf.LambdaFunctionFailedEventAttributes{
+				ScheduledEventId: aws.Int64(scheduledEventID),
+				Reason:           aws.String(o.err.Error()),
+			}
+			return event
+		}
+		event.EventType = aws.String("LambdaFunctionCompleted")
+		event.LambdaFunctionCompletedEventAttributes = &swf.LambdaFunctionCompletedEventAttributes{
+			ScheduledEventId: aws.Int64(scheduledEventID),
+			Result:           aws.String(o.result),
+		}
+	case <-ctx.Done():
+		event.EventType = aws.String("LambdaFunctionTimedOut")
+		event.LambdaFunctionTimedOutEventAttributes = &swf.LambdaFunctionTimedOutEventAttributes{
+			ScheduledEventId: aws.Int64(scheduledEventID),
+			TimeoutType:      aws.String(swf.LambdaFunctionTimeoutTypeStartToClose),
+		}
+	}
+	return event
+}
+
+// Result runs the function for a Lambda step and returns its result, or an error if it failed or timed out
+func (l *LocalLambdas) Result(next *NextActivity) (string, error) {
+	event := l.Run(next, 0)
+	switch *event.EventType {
+	case "LambdaFunctionCompleted":
+		return aws.StringValue(event.LambdaFunctionCompletedEventAttributes.Result), nil
+	case "LambdaFunctionTimedOut":
+		return "", fmt.Errorf("lambda %s timed out", next.Name)
+	}
+	return "", errors.New(aws.StringValue(event.LambdaFunctionFailedEventAttributes.Reason))
+}
@@ -0,0 +1,231 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+	"golang.org/x/net/context"
+)
+
+// sentDecision is the part of a decision sent to SWF that the tests check
+type sentDecision struct {
+	DecisionType                           string `json:"decisionType"`
+	ScheduleActivityTaskDecisionAttributes *struct {
+		ActivityType struct {
+			Name string `json:"name"`
+		} `json:"activityType"`
+	} `json:"scheduleActivityTaskDecisionAttributes"`
+	ScheduleLambdaFunctionDecisionAttributes *struct {
+		Name  string `json:"name"`
+		Input string `json:"input"`
+	} `json:"scheduleLambdaFunctionDecisionAttributes"`
+	FailWorkflowExecutionDecisionAttributes *struct {
+		Reason string `json:"reason"`
+	} `json:"failWorkflowExecutionDecisionAttributes"`
+	RecordMarkerDecisionAttributes *struct {
+		MarkerName string `json:"markerName"`
+	} `json:"recordMarkerDecisionAttributes"`
+}
+
+// fakeSWF records the decisions a decider responds with
+type fakeSWF struct {
+	mu        sync.Mutex
+	decisions [][]sentDecision
+}
+
+func (f *fakeSWF) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".RespondDecisionTaskCompleted") {
+		var input struct {
+			Decisions []sentDecision `json:"decisions"`
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		f.mu.Lock()
+		f.decisions = append(f.decisions, input.Decisions)
+		f.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Write([]byte("{}"))
+}
+
+// responses returns the decision types of each response, eg. ["ScheduleActivityTask"]
+func (f *fakeSWF) responses() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var types []string
+	for _, decisions := range f.decisions {
+		var t []string
+		for _, decision := range decisions {
+			t = append(t, decision.DecisionType)
+		}
+		types = append(types, strings.Join(t, ","))
+	}
+	return types
+}
+
+// fakeMailer records the subjects of the emails sent
+type fakeMailer struct {
+	mu       sync.Mutex
+	subjects []string
+}
+
+func (m *fakeMailer) Send(e *amazon.Email) error {
+	m.mu.Lock()
+	m.subjects = append(m.subjects, e.Subject)
+	m.mu.Unlock()
+	return nil
+}
+
+// testDecider returns a decider that responds to a fake SWF and emails through a fake mailer
+func testDecider(t *testing.T) (*Decider, *fakeSWF, *fakeMailer, func()) {
+	f := &fakeSWF{}
+	server := httptest.NewServer(f)
+	cfg := &amazon.Config{Region: "us-east-1", Endpoint: server.URL, AccessKeyID: "test", SecretAccessKey: "test"}
+	sess, err := cfg.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMailer{}
+	d := &Decider{cfg: cfg, svc: swf.New(sess), swfDomain: "rapidtrade", Mailer: m}
+	return d, f, m, server.Close
+}
+
+func TestLambdaDecision(t *testing.T) {
+	d := &Decider{}
+	decision := d.lambdaDecision(&NextActivity{
+		Name:       "arn:aws:lambda:eu-west-1:123456789012:function:resizeimages",
+		Input:      `{"SupplierID":"1234"}`,
+		StcTimeout: "60",
+		Control:    "batch1",
+		Lambda:     true,
+	})
+	attrs := decision.ScheduleLambdaFunctionDecisionAttributes
+	if *decision.DecisionType != "ScheduleLambdaFunction" || attrs == nil {
+		t.Fatalf("got %s", *decision.DecisionType)
+	}
+	if !strings.HasPrefix(*attrs.Id, "resizeimages") || strings.Contains(*attrs.Id, ":") {
+		t.Errorf("got id %s, want the function name without the ARN", *attrs.Id)
+	}
+	if *attrs.Name != "arn:aws:lambda:eu-west-1:123456789012:function:resizeimages" || *attrs.Input != `{"SupplierID":"1234"}` {
+		t.Errorf("got name %s and input %s", *attrs.Name, *attrs.Input)
+	}
+	if aws.StringValue(attrs.StartToCloseTimeout) != "60" {
+		t.Errorf("got timeout %s", aws.StringValue(attrs.StartToCloseTimeout))
+	}
+	if control := d.parseStepControl(attrs.Control); control.Data != "batch1" {
+		t.Errorf("got control %+v", control)
+	}
+}
+
+func TestLambdaEvents(t *testing.T) {
+	local := &LocalLambdas{Functions: map[string]func(ctx context.Context, input string) (string, error){
+		"resizeimages": func(ctx context.Context, input string) (string, error) {
+			return "resized " + input, nil
+		},
+		"failing": func(ctx context.Context, input string) (string, error) {
+			return "", errors.New("out of memory")
+		},
+		"slow": func(ctx context.Context, input string) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		},
+	}}
+	lambda := func(name string, timeout string) *NextActivity {
+		return &NextActivity{Name: name, Input: "1234", StcTimeout: timeout, Lambda: true}
+	}
+	// run gives the history of a Lambda step that has closed, newest first
+	run := func(next *NextActivity) []*swf.HistoryEvent {
+		return []*swf.HistoryEvent{local.Run(next, 5), local.Scheduled(next, 5)}
+	}
+
+	tests := []struct {
+		name      string
+		events    []*swf.HistoryEvent
+		next      *NextActivity // what handleDecision returns
+		decideErr error
+		decided   string // the last activity and result handleDecision is given
+		responses []string
+		emails    int
+	}{
+		{"completed", run(lambda("resizeimages", "")), &NextActivity{Name: "loadorders", Version: "1", Tasklist: "SUPPLIER1"}, nil,
+			"resizeimages resized 1234", []string{"ScheduleActivityTask"}, 0},
+		{"completed then lambda", run(lambda("resizeimages", "")), lambda("resizeimages", ""), nil,
+			"resizeimages resized 1234", []string{"ScheduleLambdaFunction"}, 0},
+		{"completed then complete", run(lambda("resizeimages", "")), &NextActivity{Complete: true, Input: "done"}, nil,
+			"resizeimages resized 1234", []string{"CompleteWorkflowExecution"}, 0},
+		{"completed but handleDecision fails", run(lambda("resizeimages", "")), nil, errors.New("bad result"),
+			"resizeimages resized 1234", []string{"FailWorkflowExecution"}, 1},
+		{"failed", run(lambda("failing", "")), nil, nil, "", []string{"FailWorkflowExecution"}, 1},
+		{"not found", run(lambda("missing", "")), nil, nil, "", []string{"FailWorkflowExecution"}, 1},
+		{"timed out", run(lambda("slow", "1")), nil, nil, "", []string{"RecordMarker"}, 1},
+		{"scheduled event missing", []*swf.HistoryEvent{local.Run(lambda("resizeimages", ""), 5)}, nil, nil, "", []string{"FailWorkflowExecution"}, 0},
+		{"schedule failed", []*swf.HistoryEvent{{
+			EventId:   aws.Int64(5),
+			EventType: aws.String("ScheduleLambdaFunctionFailed"),
+			ScheduleLambdaFunctionFailedEventAttributes: &swf.ScheduleLambdaFunctionFailedEventAttributes{
+				Id:    aws.String("resizeimages"),
+				Name:  aws.String("resizeimages"),
+				Cause: aws.String("LAMBDA_SERVICE_NOT_AVAILABLE_IN_REGION"),
+			},
+		}}, nil, nil, "", []string{"FailWorkflowExecution"}, 1},
+	}
+	for _, tt := range tests {
+		d, f, m, stop := testDecider(t)
+		var decided string
+		handleDecision := func(d *Decider, dc *DecisionContext, lastActivity string, result string) (*NextActivity, error) {
+			decided = lastActivity + " " + result
+			return tt.next, tt.decideErr
+		}
+		dc := &DecisionContext{taskToken: "token", workflowID: "supplierload-1234", workflowType: "supplierload", events: tt.events}
+		d.makeDecision(dc, handleDecision, func(string) {})
+		stop()
+
+		if decided != tt.decided {
+			t.Errorf("%s: handleDecision got %q, want %q", tt.name, decided, tt.decided)
+		}
+		if got := f.responses(); !equalStrings(got, tt.responses) {
+			t.Errorf("%s: got responses %v, want %v", tt.name, got, tt.responses)
+		}
+		if len(m.subjects) != tt.emails {
+			t.Errorf("%s: got %d emails, want %d", tt.name, len(m.subjects), tt.emails)
+		}
+	}
+}
+
+func TestLocalLambdasResult(t *testing.T) {
+	local := &LocalLambdas{Functions: map[string]func(ctx context.Context, input string) (string, error){
+		"resizeimages": func(ctx context.Context, input string) (string, error) {
+			return "resized " + input, nil
+		},
+		"slow": func(ctx context.Context, input string) (string, error) {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(5 * time.Second):
+				return "finished", nil
+			}
+		},
+	}}
+	if result, err := local.Result(&NextActivity{Name: "resizeimages", Input: "1234"}); err != nil || result != "resized 1234" {
+		t.Errorf("got %q, %v", result, err)
+	}
+	if _, err := local.Result(&NextActivity{Name: "slow", StcTimeout: "1"}); err == nil {
+		t.Error("expected a timeout")
+	}
+	if _, err := local.Result(&NextActivity{Name: "missing"}); err == nil {
+		t.Error("expected an error for a function that is not there")
+	}
+
+	event := local.Run(&NextActivity{Name: "resizeimages"}, 7)
+	if *event.LambdaFunctionCompletedEventAttributes.ScheduledEventId != 7 {
+		t.Errorf("got scheduled event id %d, want 7", *event.LambdaFunctionCompletedEventAttributes.ScheduledEventId)
+	}
+}
@@ -0,0 +1,168 @@
+package workflow
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CaboodleData/gotools/file"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// Limit is a token bucket rate limit together with a cap on the number of activities in flight.
+// Leave a field as zero to not limit on it.
+type Limit struct {
+	Rate        float64 `json:"rate"`  // tasks per second
+	Burst       int     `json:"burst"` // tasks allowed at once before the rate kicks in, defaults to 1
+	MaxInFlight int     `json:"maxinflight"`
+}
+
+// Limits holds the limits per task list and per activity type used by Activity and ActivityPoller.
+// Use these to stop us flooding supplier REST endpoints that throttle us.
+type Limits struct {
+	TaskLists     map[string]Limit `json:"tasklists"`
+	ActivityTypes map[string]Limit `json:"activitytypes"`
+
+	mu        sync.Mutex
+	tasklists map[string]*limiter
+	types     map[string]*limiter
+}
+
+// LoadLimits loads limits from a JSON file as follows:
+// {"tasklists":{"SUPPLIER1":{"rate":0.5,"burst":2,"maxinflight":4}},"activitytypes":{"postorder":{"maxinflight":1}}}
+func LoadLimits(fileName string) (*Limits, error) {
+	l := &Limits{}
+	if err := file.LoadJSON(fileName, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// taskList returns the limiter for a task list, or nil if it is not limited
+func (l *Limits) taskList(name string) *limiter {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tasklists == nil {
+		l.tasklists = make(map[string]*limiter)
+	}
+	return l.get(l.tasklists, l.TaskLists, name)
+}
+
+// activityType returns the limiter for an activity type, or nil if it is not limited
+func (l *Limits) activityType(name string) *limiter {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.types == nil {
+		l.types = make(map[string]*limiter)
+	}
+	return l.get(l.types, l.ActivityTypes, name)
+}
+
+func (l *Limits) get(cache map[string]*limiter, config map[string]Limit, name string) *limiter {
+	if lim, ok := cache[name]; ok {
+		return lim
+	}
+	cfg, ok := config[name]
+	if !ok {
+		return nil
+	}
+	lim := newLimiter(cfg)
+	cache[name] = lim
+	return lim
+}
+
+// limitActivity wraps the handler so that it waits for its activity type's limits before it runs.
+// If started is not nil it is closed as soon as the handler starts, or gives up waiting.
+func (l *Limits) limitActivity(handleActivity func(ctx context.Context, name string, input string) (string, error), started chan struct{}) func(ctx context.Context, name string, input string) (string, error) {
+	return func(ctx context.Context, name string, input string) (string, error) {
+		release, err := l.activityType(name).acquire(ctx)
+		if started != nil {
+			close(started)
+		}
+		if err != nil {
+			return "", err
+		}
+		defer release()
+		return handleActivity(ctx, name, input)
+	}
+}
+
+// limiter enforces a single Limit, a nil limiter does not limit anything
+type limiter struct {
+	bucket *rate.Limiter
+	slots  chan struct{}
+}
+
+func newLimiter(cfg Limit) *limiter {
+	lim := &limiter{}
+	if cfg.Rate > 0 {
+		burst := cfg.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		lim.bucket = rate.NewLimiter(rate.Limit(cfg.Rate), burst)
+	}
+	if cfg.MaxInFlight > 0 {
+		lim.slots = make(chan struct{}, cfg.MaxInFlight)
+	}
+	return lim
+}
+
+// acquire waits for a slot and a token, or until ctx is done. Call release when the task is finished.
+func (lim *limiter) acquire(ctx context.Context) (release func(), err error) {
+	if lim == nil {
+		return func() {}, nil
+	}
+	if lim.slots != nil {
+		select {
+		case lim.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if lim.bucket != nil {
+		if err := lim.bucket.Wait(ctx); err != nil {
+			lim.release()
+			return nil, err
+		}
+	}
+	return lim.release, nil
+}
+
+// reserve waits for a slot and until a token is free before we poll, but does not take the token, so an empty
+// poll costs nothing. Call start when a task is received, which takes the token, waiting for it if another poll
+// got there first, and returns the release to call when the task is finished. Otherwise call cancel.
+func (lim *limiter) reserve() (start func() (release func()), cancel func()) {
+	if lim == nil {
+		return func() func() { return func() {} }, func() {}
+	}
+	if lim.slots != nil {
+		lim.slots <- struct{}{}
+	}
+	if lim.bucket == nil {
+		return func() func() { return lim.release }, lim.release
+	}
+	// reserve and cancel at the same instant to find out when a token is free without using it up
+	now := time.Now()
+	r := lim.bucket.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	r.CancelAt(now)
+	time.Sleep(delay)
+	return func() func() {
+		// if another poll sharing these limits took the token first, wait for the next one so the rate holds
+		time.Sleep(lim.bucket.ReserveN(time.Now(), 1).Delay())
+		return lim.release
+	}, lim.release
+}
+
+func (lim *limiter) release() {
+	if lim.slots != nil {
+		<-lim.slots
+	}
+}
@@ -0,0 +1,135 @@
+package workflow
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestLimiterNil(t *testing.T) {
+	var lim *limiter
+	release, err := lim.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	start, cancel := lim.reserve()
+	cancel()
+	start()()
+}
+
+func TestLimiterMaxInFlight(t *testing.T) {
+	lim := newLimiter(Limit{MaxInFlight: 1})
+	release, err := lim.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only slot is taken, so a second acquire gives up when its context does
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = lim.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	release()
+	release, err = lim.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("slot was not released: %v", err)
+	}
+	release()
+
+	// a reserve holds the slot until its task is released or the poll is cancelled
+	start, cancelPoll := lim.reserve()
+	if len(lim.slots) != 1 {
+		t.Errorf("reserve did not take the slot")
+	}
+	cancelPoll()
+	if len(lim.slots) != 0 {
+		t.Errorf("cancel did not give the slot back")
+	}
+	start, _ = lim.reserve()
+	start()()
+	if len(lim.slots) != 0 {
+		t.Errorf("release did not give the slot back")
+	}
+}
+
+func TestLimiterReserveEmptyPolls(t *testing.T) {
+	// one token every 50ms, which is there to begin with
+	lim := newLimiter(Limit{Rate: 20})
+	began := time.Now()
+	for i := 0; i < 5; i++ {
+		_, cancel := lim.reserve()
+		cancel()
+	}
+	start, _ := lim.reserve()
+	start()
+	if elapsed := time.Since(began); elapsed > 30*time.Millisecond {
+		t.Errorf("empty polls used up tokens, took %s", elapsed)
+	}
+
+	// the token has now gone, so the next poll waits for another
+	began = time.Now()
+	start, _ = lim.reserve()
+	start()
+	if elapsed := time.Since(began); elapsed < 30*time.Millisecond {
+		t.Errorf("poll did not wait for a token, took %s", elapsed)
+	}
+}
+
+func TestLimiterStartWaitsForTakenToken(t *testing.T) {
+	lim := newLimiter(Limit{Rate: 20})
+	began := time.Now()
+	start, _ := lim.reserve()
+	// another poll sharing the limits takes the token while we are polling
+	if !lim.bucket.Allow() {
+		t.Fatal("expected a token")
+	}
+	start()
+	if elapsed := time.Since(began); elapsed < 30*time.Millisecond {
+		t.Errorf("start ran the task without a token, took %s", elapsed)
+	}
+}
+
+func TestLimitActivity(t *testing.T) {
+	l := &Limits{ActivityTypes: map[string]Limit{"postorder": {MaxInFlight: 1}}}
+	handler := func(ctx context.Context, name string, input string) (string, error) {
+		return name + " " + input, nil
+	}
+
+	started := make(chan struct{})
+	result, err := l.limitActivity(handler, started)(context.Background(), "postorder", "1234")
+	if err != nil || result != "postorder 1234" {
+		t.Errorf("got %q, %v", result, err)
+	}
+	select {
+	case <-started:
+	default:
+		t.Error("started was not closed")
+	}
+
+	// hold the only postorder slot, so the next one waits until its context is cancelled
+	release, err := l.activityType("postorder").acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	started = make(chan struct{})
+	if _, err = l.limitActivity(handler, started)(ctx, "postorder", "1234"); err == nil {
+		t.Error("expected an error once the context is done")
+	}
+	select {
+	case <-started:
+	default:
+		t.Error("started was not closed after giving up")
+	}
+
+	// other activity types are not limited
+	if _, err = l.limitActivity(handler, nil)(context.Background(), "loadorders", "1234"); err != nil {
+		t.Errorf("loadorders: %v", err)
+	}
+}
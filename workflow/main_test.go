@@ -0,0 +1,15 @@
+package workflow
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain sets up the loggers, which are otherwise only set when polling starts
+func TestMain(m *testing.M) {
+	Info = log.New(ioutil.Discard, "", 0)
+	Error = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
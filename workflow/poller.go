@@ -0,0 +1,237 @@
+package workflow
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/file"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+	"golang.org/x/net/context"
+)
+
+// ActivityPoller polls a dynamic set of task lists, so one process can serve all suppliers
+// instead of running one Activity per supplier task list.
+//
+// Each task list has its own poll loop. A worker slot is only taken once a task is received, so idle long polls
+// do not hold slots a busy task list could use. A task waits for a slot while heartbeating, and its loop does not
+// poll again until it has started, so at most one task per task list is waiting. Slots are handed out first come
+// first served, so a busy task list goes to the back of the queue after each task and cannot starve the others.
+type ActivityPoller struct {
+	cfg         *amazon.Config
+	svc         *swf.SWF
+	swfDomain   string
+	swfIdentity string
+	// Workers is the maximum number of activities running at once across all task lists
+	Workers int
+	// HeartbeatInterval is passed on to each activity, see Activity.HeartbeatInterval
+	HeartbeatInterval time.Duration
+	// Limits optionally rate limits task lists and activity types, see LoadLimits
+	Limits *Limits
+	// Health optionally reports the poll loops and running tasks to an orchestrator, see NewHealth
+	Health *Health
+
+	mu             sync.Mutex
+	tasklists      map[string]chan struct{} // closed to stop polling that task list
+	slots          chan struct{}
+	handleActivity func(ctx context.Context, name string, input string) (string, error)
+}
+
+// pollerConfig is the JSON file read by LoadTaskLists, eg. {"tasklists":["SUPPLIER1","SUPPLIER2"]}
+type pollerConfig struct {
+	TaskLists []string `json:"tasklists"`
+}
+
+// NewActivityPoller sets up the struc, add task lists with AddTaskList, SetTaskLists or LoadTaskLists
+func NewActivityPoller(cfg *amazon.Config, swfDomain string, swfIdentity string, workers int) *ActivityPoller {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &ActivityPoller{
+		cfg:               cfg,
+		swfDomain:         swfDomain,
+		swfIdentity:       swfIdentity,
+		Workers:           workers,
+		HeartbeatInterval: 30 * time.Second,
+		tasklists:         make(map[string]chan struct{}),
+	}
+	return p
+}
+
+// AddTaskList starts serving a task list, it does nothing if the task list is already served
+func (p *ActivityPoller) AddTaskList(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.tasklists[name]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	p.tasklists[name] = stop
+	if p.handleActivity != nil {
+		go p.pollTaskList(name, stop)
+	}
+}
+
+// RemoveTaskList stops serving a task list. A task already received from it still runs to the end.
+func (p *ActivityPoller) RemoveTaskList(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stop, ok := p.tasklists[name]; ok {
+		close(stop)
+		delete(p.tasklists, name)
+	}
+}
+
+// SetTaskLists adds and removes task lists so that exactly the given names are served
+func (p *ActivityPoller) SetTaskLists(names []string) {
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name] = true
+		p.AddTaskList(name)
+	}
+	for _, name := range p.TaskLists() {
+		if !want[name] {
+			p.RemoveTaskList(name)
+		}
+	}
+}
+
+// TaskLists returns the names of the task lists currently served
+func (p *ActivityPoller) TaskLists() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var names []string
+	for name := range p.tasklists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadTaskLists reads the task lists from a JSON config file and serves exactly those
+// The file needs to be as follows: {"tasklists":["SUPPLIER1","SUPPLIER2"]}
+func (p *ActivityPoller) LoadTaskLists(fileName string) error {
+	var cfg pollerConfig
+	if err := file.LoadJSON(fileName, &cfg); err != nil {
+		return err
+	}
+	p.SetTaskLists(cfg.TaskLists)
+	return nil
+}
+
+// WatchConfig reloads the task lists from the config file every interval, so suppliers can be added and removed
+// without restarting. Errors reading the file are logged and the current task lists are kept.
+func (p *ActivityPoller) WatchConfig(fileName string, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := p.LoadTaskLists(fileName); err != nil {
+				Error.Printf("error: unable to reload task lists from %s: %v\n", fileName, err)
+			}
+		}
+	}()
+}
+
+// StartPolling starts a poll loop for every task list and blocks forever, ensure to pass in the call back function to handle the activity
+func (p *ActivityPoller) StartPolling(stdout bool, logfolder string, logname string, handleActivity func(ctx context.Context, name string, input string) (result string, err error)) error {
+	Info, Error = file.InitLogs(stdout, logfolder, logname)
+	Info.Println("Starting " + p.swfIdentity + " ==>")
+
+	svc, err := amazon.SWFNewSession(p.cfg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.svc = svc
+	p.slots = make(chan struct{}, p.Workers)
+	p.handleActivity = handleActivity
+	for name, stop := range p.tasklists {
+		go p.pollTaskList(name, stop)
+	}
+	p.mu.Unlock()
+
+	select {}
+}
+
+// pollTaskList is the poll loop for one task list, it stops when stop is closed
+func (p *ActivityPoller) pollTaskList(tasklist string, stop chan struct{}) {
+	Info.Printf("Starting polling for %s", tasklist)
+	params := &swf.PollForActivityTaskInput{
+		Domain: aws.String(p.swfDomain),
+		TaskList: &swf.TaskList{
+			Name: aws.String(tasklist),
+		},
+		Identity: aws.String(p.swfIdentity),
+	}
+
+	tasklistLimit := p.Limits.taskList(tasklist)
+	for {
+		// wait for the task list limits before polling, so we only accept work they allow
+		start, cancel := tasklistLimit.reserve()
+		select {
+		case <-stop:
+			cancel()
+			Info.Printf("Stopped polling for %s", tasklist)
+			return
+		default:
+		}
+
+		p.Health.beat()
+		resp, err := p.svc.PollForActivityTask(params)
+		p.Health.polled(err)
+		if err != nil {
+			cancel()
+			Error.Printf("error: unable to poll for %s: %v\n", tasklist, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		// if we do not receive a task token then 60 second time out occured so try again
+		if resp.TaskToken == nil || *resp.TaskToken == "" {
+			cancel()
+			continue
+		}
+
+		a := &Activity{
+			cfg:               p.cfg,
+			svc:               p.svc,
+			tt:                *resp.TaskToken,
+			input:             aws.StringValue(resp.Input),
+			name:              *resp.ActivityType.Name,
+			swfDomain:         p.swfDomain,
+			swfTasklist:       tasklist,
+			swfIdentity:       p.swfIdentity,
+			HeartbeatInterval: p.HeartbeatInterval,
+		}
+		release := start()
+		started := make(chan struct{})
+		done := p.Health.taskStarted(a.name, tasklist, aws.StringValue(resp.WorkflowExecution.WorkflowId))
+		go func() {
+			defer func() {
+				done()
+				release()
+			}()
+			a.runActivity(p.withWorker(p.Limits.limitActivity(p.handleActivity, started), started))
+		}()
+		// do not poll again until this task has got a worker and past its activity type limits
+		<-started
+	}
+}
+
+// withWorker wraps the handler so that it waits for a free worker slot before it runs, or until ctx is done.
+// started is closed if it gives up, as the wrapped handler never gets to close it.
+func (p *ActivityPoller) withWorker(handleActivity func(ctx context.Context, name string, input string) (string, error), started chan struct{}) func(ctx context.Context, name string, input string) (string, error) {
+	return func(ctx context.Context, name string, input string) (string, error) {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			close(started)
+			return "", ctx.Err()
+		}
+		defer func() { <-p.slots }()
+		return handleActivity(ctx, name, input)
+	}
+}
@@ -0,0 +1,292 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// Marker names recorded while compensating
+const (
+	compensationStartedMarker = "CompensationStarted"
+	compensationMarker        = "Compensation"
+)
+
+// Compensation is the activity that undoes a step, eg. deleting the GCS file or BigQuery table the step created.
+// If a later step fails the decider runs the compensations of all completed steps in reverse order before failing the workflow.
+type Compensation struct {
+	Name       string
+	Version    string
+	Input      string
+	StcTimeout string
+	Tasklist   string
+}
+
+// stepControl is kept in the Control field of each scheduled activity, so the decider can rebuild
+// what needs compensating from the workflow history alone
+type stepControl struct {
+	Compensation    *Compensation `json:",omitempty"`
+	CompensationFor string        `json:",omitempty"` // activity id of the step this activity compensates
+	CompensationOf  int64         `json:",omitempty"` // scheduled event id of that step, as activity ids may repeat
+	Data            string        `json:",omitempty"` // the control set on NextActivity
+}
+
+// compensationStarted is the detail of the CompensationStarted marker, holding why the workflow is failing
+// and the step it failed on, as once compensating the latest activities are the compensations
+type compensationStarted struct {
+	Details    string
+	Reason     string
+	FailedStep *failedStep `json:",omitempty"`
+}
+
+// compensationOutcome is the detail of a Compensation marker
+type compensationOutcome struct {
+	Step             string // activity id of the step compensated
+	StepEventID      int64  // scheduled event id of the step compensated
+	Activity         string // compensation activity name
+	ScheduledEventID int64  // 0 if the compensation could not be scheduled
+	Outcome          string // completed, failed, timedout, canceled or schedulefailed
+	Reason           string
+}
+
+// compensationIDPrefix starts the activity id of each compensation, followed by the scheduled event id of the
+// step and the compensation name, so a ScheduleActivityTaskFailed can be traced back to its step
+const compensationIDPrefix = "compensate-"
+
+// compensationStep returns the scheduled event id of the step a compensation activity id is for, or 0
+func compensationStep(activityID string) int64 {
+	if !strings.HasPrefix(activityID, compensationIDPrefix) {
+		return 0
+	}
+	rest := strings.TrimPrefix(activityID, compensationIDPrefix)
+	if i := strings.Index(rest, "-"); i > 0 {
+		rest = rest[:i]
+	}
+	id, _ := strconv.ParseInt(rest, 10, 64)
+	return id
+}
+
+// getStepControl reads our control data off a scheduled activity, it is empty if there is none
+func (d *Decider) getStepControl(attrs *swf.ActivityTaskScheduledEventAttributes) *stepControl {
+	return d.parseStepControl(attrs.Control)
+}
+
+func (d *Decider) parseStepControl(control *string) *stepControl {
+	c := &stepControl{}
+	if control != nil {
+		json.Unmarshal([]byte(*control), c)
+	}
+	return c
+}
+
+// failWithCompensation fails the workflow, but first runs the compensations of any completed steps
+func (d *Decider) failWithCompensation(dc *DecisionContext, details string, err error) error {
+	if len(d.getPendingCompensations(dc.events)) == 0 {
+		return d.failWorkflow(dc, details, err)
+	}
+	started := compensationStarted{Details: details, FailedStep: d.getFailedStep(dc.events)}
+	if err != nil {
+		started.Reason = fmt.Sprintf("%v", err)
+	}
+	b, _ := json.Marshal(started)
+	Info.Println("Compensating completed steps before failing workflow")
+	decisions := []*swf.Decision{d.markerDecision(compensationStartedMarker, string(b))}
+	decisions = append(decisions, d.nextCompensationDecision(dc.events, nil))
+	return d.respondDecisions(dc, decisions, "Data")
+}
+
+// isCompensating checks if we have started compensating this workflow
+func (d *Decider) isCompensating(events []*swf.HistoryEvent) bool {
+	return d.getCompensationStarted(events) != nil
+}
+
+func (d *Decider) getCompensationStarted(events []*swf.HistoryEvent) *compensationStarted {
+	for _, event := range events {
+		if *event.EventType == "MarkerRecorded" && *event.MarkerRecordedEventAttributes.MarkerName == compensationStartedMarker {
+			started := &compensationStarted{}
+			json.Unmarshal([]byte(aws.StringValue(event.MarkerRecordedEventAttributes.Details)), started)
+			return started
+		}
+	}
+	return nil
+}
+
+// handleCompensating records the outcome of each compensation that has closed, or could not be scheduled,
+// then schedules the next one. Once there is nothing left to compensate the workflow is failed with the original reason.
+func (d *Decider) handleCompensating(dc *DecisionContext) error {
+	events := dc.events
+	recorded := make(map[int64]bool)
+	recordedSteps := make(map[int64]bool)
+	closed := make(map[int64]*swf.HistoryEvent)
+	scheduled := make(map[int64]*swf.HistoryEvent)
+	scheduleFailed := make(map[int64]*swf.HistoryEvent) // by step
+	for _, event := range events {
+		switch *event.EventType {
+		case "MarkerRecorded":
+			if *event.MarkerRecordedEventAttributes.MarkerName == compensationMarker {
+				var outcome compensationOutcome
+				json.Unmarshal([]byte(aws.StringValue(event.MarkerRecordedEventAttributes.Details)), &outcome)
+				recorded[outcome.ScheduledEventID] = true
+				recordedSteps[outcome.StepEventID] = true
+			}
+		case "ActivityTaskScheduled":
+			scheduled[*event.EventId] = event
+		case "ScheduleActivityTaskFailed":
+			if step := compensationStep(*event.ScheduleActivityTaskFailedEventAttributes.ActivityId); step != 0 {
+				scheduleFailed[step] = event
+			}
+		default:
+			if id := d.getScheduledEventID(event); id != 0 {
+				closed[id] = event
+			}
+		}
+	}
+
+	var decisions []*swf.Decision
+	waiting := false
+	for id, event := range scheduled {
+		attrs := event.ActivityTaskScheduledEventAttributes
+		control := d.getStepControl(attrs)
+		if control.CompensationFor == "" {
+			continue
+		}
+		closeEvent, ok := closed[id]
+		if !ok {
+			waiting = true
+			continue
+		}
+		if recorded[id] {
+			continue
+		}
+		outcome := compensationOutcome{
+			Step:             control.CompensationFor,
+			StepEventID:      control.CompensationOf,
+			Activity:         *attrs.ActivityType.Name,
+			ScheduledEventID: id,
+		}
+		switch *closeEvent.EventType {
+		case "ActivityTaskCompleted":
+			outcome.Outcome = "completed"
+		case "ActivityTaskFailed":
+			outcome.Outcome = "failed"
+			outcome.Reason = aws.StringValue(closeEvent.ActivityTaskFailedEventAttributes.Reason)
+		case "ActivityTaskTimedOut":
+			outcome.Outcome = "timedout"
+			outcome.Reason = aws.StringValue(closeEvent.ActivityTaskTimedOutEventAttributes.TimeoutType)
+		case "ActivityTaskCanceled":
+			outcome.Outcome = "canceled"
+		}
+		Info.Printf("Compensation %s for %s %s", outcome.Activity, outcome.Step, outcome.Outcome)
+		b, _ := json.Marshal(outcome)
+		decisions = append(decisions, d.markerDecision(compensationMarker, string(b)))
+	}
+
+	// a compensation that could not be scheduled, eg. its type is not registered, will not be tried again
+	skip := make(map[int64]bool)
+	for step, event := range scheduleFailed {
+		if recordedSteps[step] {
+			continue
+		}
+		skip[step] = true
+		attrs := event.ScheduleActivityTaskFailedEventAttributes
+		outcome := compensationOutcome{
+			StepEventID: step,
+			Activity:    *attrs.ActivityType.Name,
+			Outcome:     "schedulefailed",
+			Reason:      aws.StringValue(attrs.Cause),
+		}
+		if stepEvent, ok := scheduled[step]; ok {
+			outcome.Step = *stepEvent.ActivityTaskScheduledEventAttributes.ActivityId
+		}
+		Info.Printf("Compensation %s for %s %s: %s", outcome.Activity, outcome.Step, outcome.Outcome, outcome.Reason)
+		b, _ := json.Marshal(outcome)
+		decisions = append(decisions, d.markerDecision(compensationMarker, string(b)))
+	}
+
+	// compensations run one at a time, so wait for the running one to close
+	if !waiting {
+		if len(d.pendingCompensations(events, skip)) > 0 {
+			decisions = append(decisions, d.nextCompensationDecision(events, skip))
+		} else {
+			started := d.getCompensationStarted(events)
+			d.deadLetter(dc, started.Reason, started.Details, started.FailedStep)
+			Info.Println("Compensation finished, failing workflow")
+			decisions = append(decisions, d.failWorkflowDecision(started.Details, started.Reason))
+		}
+	}
+	return d.respondDecisions(dc, decisions, "Data")
+}
+
+// getPendingCompensations returns the scheduled events of completed steps that still need compensating,
+// most recently completed first
+func (d *Decider) getPendingCompensations(events []*swf.HistoryEvent) []*swf.HistoryEvent {
+	return d.pendingCompensations(events, nil)
+}
+
+// pendingCompensations is getPendingCompensations leaving out the steps in skip, by scheduled event id.
+// A step counts as compensated once its compensation is scheduled or recorded as unable to be scheduled.
+func (d *Decider) pendingCompensations(events []*swf.HistoryEvent, skip map[int64]bool) []*swf.HistoryEvent {
+	scheduled := make(map[int64]*swf.HistoryEvent)
+	compensated := make(map[int64]bool)
+	for id := range skip {
+		compensated[id] = true
+	}
+	for _, event := range events {
+		switch *event.EventType {
+		case "ActivityTaskScheduled":
+			scheduled[*event.EventId] = event
+			if control := d.getStepControl(event.ActivityTaskScheduledEventAttributes); control.CompensationOf != 0 {
+				compensated[control.CompensationOf] = true
+			}
+		case "MarkerRecorded":
+			if *event.MarkerRecordedEventAttributes.MarkerName == compensationMarker {
+				var outcome compensationOutcome
+				json.Unmarshal([]byte(aws.StringValue(event.MarkerRecordedEventAttributes.Details)), &outcome)
+				compensated[outcome.StepEventID] = true
+			}
+		}
+	}
+	var pending []*swf.HistoryEvent
+	// events are newest first, so this gives us reverse order of completion
+	for _, event := range events {
+		if *event.EventType != "ActivityTaskCompleted" {
+			continue
+		}
+		step, ok := scheduled[*event.ActivityTaskCompletedEventAttributes.ScheduledEventId]
+		if !ok {
+			continue
+		}
+		attrs := step.ActivityTaskScheduledEventAttributes
+		if d.getStepControl(attrs).Compensation != nil && !compensated[*step.EventId] {
+			pending = append(pending, step)
+		}
+	}
+	return pending
+}
+
+// nextCompensationDecision schedules the compensation of the most recently completed step not yet compensated,
+// leaving out the steps in skip
+func (d *Decider) nextCompensationDecision(events []*swf.HistoryEvent, skip map[int64]bool) *swf.Decision {
+	stepEvent := d.pendingCompensations(events, skip)[0]
+	step := stepEvent.ActivityTaskScheduledEventAttributes
+	c := d.getStepControl(step).Compensation
+	Info.Printf("Scheduling compensation %s for %s\n", c.Name, *step.ActivityId)
+	id := compensationIDPrefix + strconv.FormatInt(*stepEvent.EventId, 10) + "-" + c.Name
+	next := &NextActivity{Name: c.Name, Version: c.Version, Input: c.Input, StcTimeout: c.StcTimeout, Tasklist: c.Tasklist}
+	return d.scheduleActivityDecision(id, next, &stepControl{CompensationFor: *step.ActivityId, CompensationOf: *stepEvent.EventId})
+}
+
+// markerDecision records a marker in the workflow history
+func (d *Decider) markerDecision(name string, details string) *swf.Decision {
+	return &swf.Decision{
+		DecisionType: aws.String("RecordMarker"),
+		RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{
+			MarkerName: aws.String(name),
+			Details:    aws.String(details),
+		},
+	}
+}
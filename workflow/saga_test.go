@@ -0,0 +1,137 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// history builds a workflow history newest first, as the decider sees it, from events given oldest first
+func history(events ...*swf.HistoryEvent) []*swf.HistoryEvent {
+	h := make([]*swf.HistoryEvent, len(events))
+	for i, event := range events {
+		event.EventId = aws.Int64(int64(i + 1))
+		h[len(events)-1-i] = event
+	}
+	return h
+}
+
+func scheduledEvent(id string, name string, control *stepControl) *swf.HistoryEvent {
+	attrs := &swf.ActivityTaskScheduledEventAttributes{
+		ActivityId:   aws.String(id),
+		ActivityType: &swf.ActivityType{Name: aws.String(name), Version: aws.String("1")},
+	}
+	if control != nil {
+		b, _ := json.Marshal(control)
+		attrs.Control = aws.String(string(b))
+	}
+	return &swf.HistoryEvent{EventType: aws.String("ActivityTaskScheduled"), ActivityTaskScheduledEventAttributes: attrs}
+}
+
+func completedEvent(scheduledID int64) *swf.HistoryEvent {
+	return &swf.HistoryEvent{
+		EventType:                            aws.String("ActivityTaskCompleted"),
+		ActivityTaskCompletedEventAttributes: &swf.ActivityTaskCompletedEventAttributes{ScheduledEventId: aws.Int64(scheduledID)},
+	}
+}
+
+func scheduleFailedEvent(id string, name string) *swf.HistoryEvent {
+	return &swf.HistoryEvent{
+		EventType: aws.String("ScheduleActivityTaskFailed"),
+		ScheduleActivityTaskFailedEventAttributes: &swf.ScheduleActivityTaskFailedEventAttributes{
+			ActivityId:   aws.String(id),
+			ActivityType: &swf.ActivityType{Name: aws.String(name), Version: aws.String("1")},
+			Cause:        aws.String("ACTIVITY_TYPE_DOES_NOT_EXIST"),
+		},
+	}
+}
+
+func compensationMarkerEvent(outcome compensationOutcome) *swf.HistoryEvent {
+	b, _ := json.Marshal(outcome)
+	return &swf.HistoryEvent{
+		EventType: aws.String("MarkerRecorded"),
+		MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+			MarkerName: aws.String(compensationMarker),
+			Details:    aws.String(string(b)),
+		},
+	}
+}
+
+func TestPendingCompensations(t *testing.T) {
+	d := &Decider{}
+	undo := &stepControl{Compensation: &Compensation{Name: "deletetable", Version: "1"}}
+
+	tests := []struct {
+		name    string
+		events  []*swf.HistoryEvent
+		skip    map[int64]bool
+		pending []int64 // scheduled event ids of the steps, most recently completed first
+	}{
+		{"none completed", history(scheduledEvent("load201703010600", "load", undo)), nil, nil},
+		{"no compensation", history(scheduledEvent("load201703010600", "load", nil), completedEvent(1)), nil, nil},
+		{"two completed", history(
+			scheduledEvent("load201703010600", "load", undo), completedEvent(1),
+			scheduledEvent("merge201703010600", "merge", undo), completedEvent(3),
+		), nil, []int64{3, 1}},
+		// the same step run twice in a minute gets the same activity id, only the one compensated is done
+		{"same activity id", history(
+			scheduledEvent("load201703010600", "load", undo), completedEvent(1),
+			scheduledEvent("load201703010600", "load", undo), completedEvent(3),
+			scheduledEvent("compensate-3-deletetable", "deletetable", &stepControl{CompensationFor: "load201703010600", CompensationOf: 3}),
+		), nil, []int64{1}},
+		{"schedule failed recorded", history(
+			scheduledEvent("load201703010600", "load", undo), completedEvent(1),
+			scheduledEvent("merge201703010600", "merge", undo), completedEvent(3),
+			scheduleFailedEvent("compensate-3-deletetable", "deletetable"),
+			compensationMarkerEvent(compensationOutcome{StepEventID: 3, Activity: "deletetable", Outcome: "schedulefailed"}),
+		), nil, []int64{1}},
+		{"skipped", history(
+			scheduledEvent("load201703010600", "load", undo), completedEvent(1),
+			scheduledEvent("merge201703010600", "merge", undo), completedEvent(3),
+		), map[int64]bool{3: true}, []int64{1}},
+	}
+	for _, tt := range tests {
+		var got []int64
+		for _, event := range d.pendingCompensations(tt.events, tt.skip) {
+			got = append(got, *event.EventId)
+		}
+		if len(got) != len(tt.pending) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.pending)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.pending[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.pending)
+				break
+			}
+		}
+	}
+}
+
+func TestNextCompensationDecision(t *testing.T) {
+	d := &Decider{}
+	undo := &stepControl{Compensation: &Compensation{Name: "deletetable", Version: "1", Tasklist: "SUPPLIER1"}}
+	events := history(
+		scheduledEvent("load201703010600", "load", undo), completedEvent(1),
+		scheduledEvent("merge201703010600", "merge", undo), completedEvent(3),
+	)
+	decision := d.nextCompensationDecision(events, map[int64]bool{3: true})
+	attrs := decision.ScheduleActivityTaskDecisionAttributes
+	if *attrs.ActivityId != "compensate-1-deletetable" {
+		t.Errorf("got activity id %s", *attrs.ActivityId)
+	}
+	if step := compensationStep(*attrs.ActivityId); step != 1 {
+		t.Errorf("got step %d from %s, want 1", step, *attrs.ActivityId)
+	}
+	control := d.parseStepControl(attrs.Control)
+	if control.CompensationFor != "load201703010600" || control.CompensationOf != 1 {
+		t.Errorf("got control %+v", control)
+	}
+	for _, id := range []string{"load201703010600", "compensate-", "compensate-x-deletetable"} {
+		if step := compensationStep(id); step != 0 {
+			t.Errorf("%s: got step %d, want 0", id, step)
+		}
+	}
+}
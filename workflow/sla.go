@@ -0,0 +1,198 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// Names used in the workflow history for SLAs
+const (
+	slaTimerPrefix     = "sla-" // SWF does not allow : / or | in a timer id
+	slaEscalatedMarker = "SLAEscalation"
+)
+
+// SLA is the deadline of a workflow type, set either as a duration from when the workflow started or as a time of day.
+// A timer is started for each escalation when the workflow starts, eg. a supplier load that must finish by 06:00:
+//
+//	d.SLAs = map[string]*workflow.SLA{"supplierload": {
+//		By: "06:00",
+//		Escalations: []workflow.Escalation{
+//			{Name: "warning", After: -30 * time.Minute},
+//			{Name: "page", To: "oncall@rapidtrade.biz"},
+//			{Name: "terminate", After: 2 * time.Hour, Terminate: true},
+//		},
+//	}}
+type SLA struct {
+	Within      time.Duration  // deadline from when the workflow started
+	By          string         // or the deadline as a time of day, eg. "06:00", the first one after the workflow started
+	Location    *time.Location // time zone of By, UTC if nil
+	Escalations []Escalation
+}
+
+// Escalation is sent when the workflow is still open at a time relative to the SLA deadline
+type Escalation struct {
+	Name      string        // eg. warning or page, unique within the SLA, it is part of a timer id so no : / or |
+	After     time.Duration // after the deadline, negative for before it
+	To        string        // who to email, the helpdesk if empty
+	Terminate bool          // cancel open activities, then fail the workflow after compensating completed steps
+}
+
+// slaEscalated is the detail of the SLAEscalation marker
+type slaEscalated struct {
+	Name      string
+	Deadline  time.Time
+	To        string
+	Terminate bool
+}
+
+// deadline works out the deadline of a workflow that started at the given time
+func (s *SLA) deadline(started time.Time) (time.Time, error) {
+	if s.By == "" {
+		return started.Add(s.Within), nil
+	}
+	t, err := time.Parse("15:04", s.By)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SLA time %s: %v", s.By, err)
+	}
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	start := started.In(loc)
+	deadline := time.Date(start.Year(), start.Month(), start.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	if !deadline.After(start) {
+		deadline = deadline.AddDate(0, 0, 1)
+	}
+	return deadline, nil
+}
+
+func (s *SLA) escalation(name string) *Escalation {
+	for i := range s.Escalations {
+		if s.Escalations[i].Name == name {
+			return &s.Escalations[i]
+		}
+	}
+	return nil
+}
+
+// isSLATimer checks if a TimerFired event is one of our SLA timers
+func (d *Decider) isSLATimer(event *swf.HistoryEvent) bool {
+	return strings.HasPrefix(*event.TimerFiredEventAttributes.TimerId, slaTimerPrefix)
+}
+
+// getSLADeadline returns the SLA and deadline of this workflow, or nil if it has no SLA
+func (d *Decider) getSLADeadline(dc *DecisionContext) (*SLA, time.Time, error) {
+	sla := d.SLAs[dc.workflowType]
+	if sla == nil {
+		return nil, time.Time{}, nil
+	}
+	for _, event := range dc.events {
+		if *event.EventType == "WorkflowExecutionStarted" {
+			deadline, err := sla.deadline(*event.EventTimestamp)
+			return sla, deadline, err
+		}
+	}
+	return nil, time.Time{}, errors.New("workflow started event missing")
+}
+
+// slaTimerDecisions starts a timer for each escalation of the workflow's SLA
+func (d *Decider) slaTimerDecisions(dc *DecisionContext) []*swf.Decision {
+	sla, deadline, err := d.getSLADeadline(dc)
+	if err != nil {
+		Error.Printf("error: unable to set SLA of %s: %v\n", dc.workflowID, err)
+		return nil
+	}
+	if sla == nil {
+		return nil
+	}
+	Info.Printf("Workflow %s is due by %s\n", dc.workflowID, deadline.Format("2006-01-02 15:04 MST"))
+	var decisions []*swf.Decision
+	for _, e := range sla.Escalations {
+		sec := math.Ceil(deadline.Add(e.After).Sub(time.Now()).Seconds())
+		if sec < 0 {
+			sec = 0
+		}
+		decisions = append(decisions, d.startTimerDecision(slaTimerPrefix+e.Name, strconv.Itoa(int(sec)), ""))
+	}
+	return decisions
+}
+
+// slaDecisions sends the escalations whose timers have fired but are not yet recorded, and returns their markers.
+// terminate is the first escalation, sent now or before, that ends the workflow, or nil if there is none.
+func (d *Decider) slaDecisions(dc *DecisionContext) (decisions []*swf.Decision, terminate *slaEscalated) {
+	recorded := make(map[string]bool)
+	var fired []string
+	for _, event := range dc.events {
+		switch *event.EventType {
+		case "MarkerRecorded":
+			if *event.MarkerRecordedEventAttributes.MarkerName == slaEscalatedMarker {
+				e := &slaEscalated{}
+				json.Unmarshal([]byte(aws.StringValue(event.MarkerRecordedEventAttributes.Details)), e)
+				recorded[e.Name] = true
+				if e.Terminate {
+					terminate = e
+				}
+			}
+		case "TimerFired":
+			if d.isSLATimer(event) {
+				fired = append(fired, strings.TrimPrefix(*event.TimerFiredEventAttributes.TimerId, slaTimerPrefix))
+			}
+		}
+	}
+	if len(fired) == 0 {
+		return nil, terminate
+	}
+	sla, deadline, err := d.getSLADeadline(dc)
+	if err != nil || sla == nil {
+		return nil, terminate
+	}
+
+	for _, name := range fired {
+		e := sla.escalation(name)
+		if e == nil || recorded[name] {
+			continue
+		}
+		recorded[name] = true
+		to := e.To
+		if to == "" {
+			to = helpdesk
+		}
+		Info.Printf("Workflow %s SLA %s, due by %s\n", dc.workflowID, e.Name, deadline.Format("2006-01-02 15:04 MST"))
+		data := d.notificationData(dc, "SLA "+e.Name)
+		data.Escalation = e.Name
+		data.Deadline = deadline
+		if err := sendTemplate(d.cfg, d.Mailer, d.Templates, "slaescalation", "support@rapidtrade.biz", to, data); err != nil {
+			Error.Printf("error: unable to send SLA %s for %s: %v\n", e.Name, dc.workflowID, err)
+		}
+		escalated := &slaEscalated{Name: e.Name, Deadline: deadline, To: to, Terminate: e.Terminate}
+		b, _ := json.Marshal(escalated)
+		decisions = append(decisions, d.markerDecision(slaEscalatedMarker, string(b)))
+		if e.Terminate && terminate == nil {
+			terminate = escalated
+		}
+	}
+	return decisions, terminate
+}
+
+// handleSLATerminate winds up a workflow that missed its SLA. Open activities are asked to cancel, then once
+// they have all closed the workflow is failed with failWithCompensation, so completed steps are undone.
+func (d *Decider) handleSLATerminate(dc *DecisionContext, e *slaEscalated) error {
+	open, decisions, err := d.cancelActivityDecisions(dc)
+	if err != nil {
+		return d.failWorkflow(dc, "", err)
+	}
+	if len(open) > 0 {
+		return d.respondDecisions(dc, decisions, "Data")
+	}
+	reason := "SLA missed, due by " + e.Deadline.Format("2006-01-02 15:04 MST")
+	Info.Printf("Failing workflow %s: %s\n", dc.workflowID, reason)
+	return d.failWithCompensation(dc, "", errors.New(reason))
+}
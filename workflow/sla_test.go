@@ -0,0 +1,53 @@
+package workflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLADeadline(t *testing.T) {
+	johannesburg := time.FixedZone("SAST", 2*60*60)
+	utc := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		name    string
+		sla     SLA
+		started time.Time
+		want    time.Time
+	}{
+		{"within", SLA{Within: 2 * time.Hour}, utc("2017-03-01 23:30"), utc("2017-03-02 01:30")},
+		{"by later today", SLA{By: "06:00"}, utc("2017-03-01 01:00"), utc("2017-03-01 06:00")},
+		{"by after midnight", SLA{By: "06:00"}, utc("2017-03-01 22:00"), utc("2017-03-02 06:00")},
+		{"by at the deadline", SLA{By: "06:00"}, utc("2017-03-01 06:00"), utc("2017-03-02 06:00")},
+		{"by just before midnight", SLA{By: "00:00"}, utc("2017-03-01 23:59"), utc("2017-03-02 00:00")},
+		{"by end of month", SLA{By: "06:00"}, utc("2017-02-28 07:00"), utc("2017-03-01 06:00")},
+		// 23:00 UTC is already 01:00 the next day in Johannesburg, so 06:00 is the same local day
+		{"by in a time zone", SLA{By: "06:00", Location: johannesburg}, utc("2017-03-01 23:00"), utc("2017-03-02 04:00")},
+		{"by in a time zone past it", SLA{By: "06:00", Location: johannesburg}, utc("2017-03-01 05:00"), utc("2017-03-02 04:00")},
+	}
+	for _, tt := range tests {
+		got, err := tt.sla.deadline(tt.started)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got.UTC(), tt.want)
+		}
+	}
+}
+
+func TestSLADeadlineInvalid(t *testing.T) {
+	for _, by := range []string{"6am", "25:00", "06:00:00"} {
+		s := &SLA{By: by}
+		if _, err := s.deadline(time.Now()); err == nil {
+			t.Errorf("%s: expected an error", by)
+		}
+	}
+}
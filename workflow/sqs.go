@@ -0,0 +1,302 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/file"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"golang.org/x/net/context"
+)
+
+// sqsActivityAttribute is the message attribute naming the activity when the body is the raw input
+const sqsActivityAttribute = "activity"
+
+// SQSTask is the body of a message on the queue, eg. {"name":"loadorders","input":"{\"SupplierID\":\"1234\"}"}.
+// A message may instead carry the name in an "activity" string attribute, the body is then the input as it is.
+type SQSTask struct {
+	Name  string `json:"name"`
+	Input string `json:"input"`
+}
+
+// SQSWorker runs the same handleActivity call back as Activity, taking tasks off an SQS queue instead of SWF.
+// A message is deleted once its handler succeeds. If the handler fails, the message is received again after
+// RetryDelay, and once it has been received MaxReceives times it is moved to DeadLetterQueue. Test against a local
+// stand-in such as ElasticMQ by setting the Endpoint of the amazon.Config.
+type SQSWorker struct {
+	cfg      *amazon.Config
+	svc      *sqs.SQS
+	queueURL string
+	queue    string
+
+	// Workers is the maximum number of tasks running at once
+	Workers int
+	// BatchSize is the most messages taken in one receive, at most 10
+	BatchSize int
+	// WaitTime is how long a receive waits for messages, at most 20 seconds
+	WaitTime time.Duration
+	// VisibilityTimeout hides a received message from other workers, it is extended every half timeout while the handler runs
+	VisibilityTimeout time.Duration
+	// RetryDelay is how long a failed message waits before it is received again
+	RetryDelay time.Duration
+	// MaxReceives is how many times a message is tried before it goes to DeadLetterQueue
+	MaxReceives int
+	// DeadLetterQueue is the URL failed messages are moved to, leave it empty if the queue has its own redrive policy
+	DeadLetterQueue string
+	// Limits optionally rate limits the activity types, see LoadLimits
+	Limits *Limits
+	// Health optionally reports the receive loop and running tasks to an orchestrator, see NewHealth
+	Health *Health
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+}
+
+// NewSQSWorker sets up the struc
+func NewSQSWorker(cfg *amazon.Config, queueURL string) *SQSWorker {
+	return &SQSWorker{
+		cfg:      cfg,
+		queueURL: queueURL,
+		queue:    queueURL[strings.LastIndex(queueURL, "/")+1:],
+
+		Workers:           1,
+		BatchSize:         10,
+		WaitTime:          20 * time.Second,
+		VisibilityTimeout: 60 * time.Second,
+		RetryDelay:        30 * time.Second,
+		MaxReceives:       5,
+		stop:              make(chan struct{}),
+	}
+}
+
+// StartPolling receives from the queue until Stop is called, ensure to pass in the call back function to handle the activity
+func (w *SQSWorker) StartPolling(stdout bool, logfolder string, handleActivity func(name string, input string) (result string, err error)) error {
+	return w.StartPollingContext(stdout, logfolder, func(ctx context.Context, name string, input string) (string, error) {
+		return handleActivity(name, input)
+	})
+}
+
+// StartPollingContext is the same as StartPolling, but the call back receives a context which is cancelled
+// if the message can no longer be kept hidden, as another worker may then receive it.
+func (w *SQSWorker) StartPollingContext(stdout bool, logfolder string, handleActivity func(ctx context.Context, name string, input string) (result string, err error)) error {
+	Info, Error = file.InitLogs(stdout, logfolder, w.queue)
+	Info.Println("Starting SQS worker for " + w.queueURL + " ==>")
+	svc, err := amazon.SQSNewSession(w.cfg)
+	if err != nil {
+		return err
+	}
+	w.svc = svc
+	workers := w.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	handler := w.Limits.limitActivity(handleActivity, nil)
+
+	for {
+		// wait for a free worker so we only receive what we can start
+		select {
+		case <-w.stop:
+			w.running.Wait()
+			Info.Printf("Stopped SQS worker for %s", w.queue)
+			return nil
+		case slots <- struct{}{}:
+		}
+		max := workers - len(slots) + 1
+		if max > w.BatchSize {
+			max = w.BatchSize
+		}
+		if max > 10 {
+			max = 10
+		}
+		if max < 1 {
+			max = 1
+		}
+
+		w.Health.beat()
+		resp, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(w.queueURL),
+			MaxNumberOfMessages:   aws.Int64(int64(max)),
+			WaitTimeSeconds:       aws.Int64(int64(w.WaitTime / time.Second)),
+			VisibilityTimeout:     aws.Int64(int64(w.VisibilityTimeout / time.Second)),
+			AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		w.Health.polled(err)
+		if err != nil {
+			<-slots
+			Error.Printf("error: unable to receive from %s: %v\n", w.queue, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if len(resp.Messages) == 0 {
+			<-slots
+			continue
+		}
+
+		for i, msg := range resp.Messages {
+			// the first message has the slot we waited for, the rest are free as we asked for no more than that
+			if i > 0 {
+				slots <- struct{}{}
+			}
+			w.running.Add(1)
+			go func(msg *sqs.Message) {
+				defer func() {
+					<-slots
+					w.running.Done()
+				}()
+				w.runMessage(msg, handler)
+			}(msg)
+		}
+	}
+}
+
+// Stop stops receiving, StartPolling returns once the running tasks have finished
+func (w *SQSWorker) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// runMessage runs the handler for one message while keeping it hidden, then deletes, retries or dead letters it
+func (w *SQSWorker) runMessage(msg *sqs.Message, handleActivity func(ctx context.Context, name string, input string) (string, error)) {
+	task, err := parseSQSTask(msg)
+	if err != nil {
+		// it can never succeed, so do not wait for the retries
+		Error.Printf("error: invalid message %s on %s: %v\n", aws.StringValue(msg.MessageId), w.queue, err)
+		w.deadLetter(msg, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go w.extendVisibility(msg, cancel, done)
+	finished := w.Health.taskStarted(task.Name, w.queue, aws.StringValue(msg.MessageId))
+	result, err := handleActivity(ctx, task.Name, task.Input)
+	finished()
+	close(done)
+	lost := ctx.Err() != nil
+	cancel()
+
+	switch {
+	case lost:
+		Error.Printf("error: %s lost its lease on %s, it will be received again\n", task.Name, w.queue)
+	case err == nil:
+		Info.Printf("Completed %s: %s", task.Name, result)
+		if _, err = w.svc.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(w.queueURL),
+			ReceiptHandle: msg.ReceiptHandle,
+		}); err != nil {
+			Error.Printf("error: unable to delete %s from %s: %v\n", aws.StringValue(msg.MessageId), w.queue, err)
+		}
+	case w.DeadLetterQueue != "" && receiveCount(msg) >= w.MaxReceives:
+		Error.Printf("error: %s failed %d times, moving to dead letter queue: %v\n", task.Name, receiveCount(msg), err)
+		w.deadLetter(msg, err)
+	default:
+		Error.Printf("error: %s failed, retrying in %s: %v\n", task.Name, w.RetryDelay, err)
+		w.changeVisibility(msg, w.RetryDelay)
+	}
+}
+
+// extendVisibility keeps the message hidden every half VisibilityTimeout until done is closed.
+// If it cannot, cancel is called as the message will be given to another worker.
+func (w *SQSWorker) extendVisibility(msg *sqs.Message, cancel context.CancelFunc, done <-chan struct{}) {
+	if w.VisibilityTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.VisibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := w.changeVisibility(msg, w.VisibilityTimeout); err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func (w *SQSWorker) changeVisibility(msg *sqs.Message, timeout time.Duration) error {
+	_, err := w.svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(w.queueURL),
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	if err != nil {
+		Error.Printf("error: unable to change visibility of %s on %s: %v\n", aws.StringValue(msg.MessageId), w.queue, err)
+	}
+	return err
+}
+
+// deadLetter copies the message to DeadLetterQueue with the error and deletes it, without a DeadLetterQueue
+// the message is left for the queue's own redrive policy
+func (w *SQSWorker) deadLetter(msg *sqs.Message, reason error) {
+	if w.DeadLetterQueue == "" {
+		return
+	}
+	attributes := msg.MessageAttributes
+	if attributes == nil {
+		attributes = make(map[string]*sqs.MessageAttributeValue)
+	}
+	attributes["error"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(reason.Error())}
+	attributes["queue"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(w.queue)}
+	if _, err := w.svc.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:          aws.String(w.DeadLetterQueue),
+		MessageBody:       msg.Body,
+		MessageAttributes: attributes,
+	}); err != nil {
+		Error.Printf("error: unable to move %s to the dead letter queue: %v\n", aws.StringValue(msg.MessageId), err)
+		return
+	}
+	if _, err := w.svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(w.queueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	}); err != nil {
+		Error.Printf("error: unable to delete %s from %s: %v\n", aws.StringValue(msg.MessageId), w.queue, err)
+	}
+}
+
+// parseSQSTask gets the activity name and input from a message
+func parseSQSTask(msg *sqs.Message) (*SQSTask, error) {
+	if a, ok := msg.MessageAttributes[sqsActivityAttribute]; ok && aws.StringValue(a.StringValue) != "" {
+		return &SQSTask{Name: aws.StringValue(a.StringValue), Input: aws.StringValue(msg.Body)}, nil
+	}
+	task := &SQSTask{}
+	if err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), task); err != nil {
+		return nil, err
+	}
+	if task.Name == "" {
+		return nil, errors.New("message has no activity name")
+	}
+	return task, nil
+}
+
+func receiveCount(msg *sqs.Message) int {
+	n, _ := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	return n
+}
+
+// SQSSendTask queues a task for an SQSWorker
+func SQSSendTask(cfg *amazon.Config, queueURL string, name string, input string) error {
+	svc, err := amazon.SQSNewSession(cfg)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&SQSTask{Name: name, Input: input})
+	if err != nil {
+		return err
+	}
+	_, err = svc.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	return err
+}
@@ -0,0 +1,86 @@
+package workflow
+
+import (
+	"html/template"
+	"time"
+
+	"github.com/CaboodleData/gotools/amazon"
+	"github.com/CaboodleData/gotools/mail"
+)
+
+// NotificationData is what the workflowerror and slaescalation email templates are rendered with
+type NotificationData struct {
+	Reason       string
+	Domain       string
+	WorkflowID   string
+	RunID        string
+	WorkflowType string
+	ConsoleURL   string
+	Escalation   string    // slaescalation only
+	Deadline     time.Time // slaescalation only
+}
+
+// ApprovalData is what the approval email template is rendered with
+type ApprovalData struct {
+	Subject      string // from the Approval, may be empty
+	Message      template.HTML
+	WorkflowID   string
+	WorkflowType string
+	ApproveURL   string
+	RejectURL    string
+	Expires      time.Time
+}
+
+// defaultTemplates are used for any email not in the Templates set on the Decider or Approvals
+var defaultTemplates = mustTemplates(map[string][2]string{
+	"workflowerror": {
+		`Workflow {{.Reason}} Occured`,
+		`<p>Workflow {{.WorkflowType}} {{.WorkflowID}} needs looking at: {{.Reason}}</p>
+<p><a href="{{.ConsoleURL}}">{{.ConsoleURL}}</a></p>`,
+	},
+	"slaescalation": {
+		`Workflow {{.WorkflowType}} SLA {{.Escalation}}`,
+		`<p>Workflow {{.WorkflowID}} has not finished, it is due by {{.Deadline.Format "2006-01-02 15:04 MST"}}.</p>
+<p><a href="{{.ConsoleURL}}">{{.ConsoleURL}}</a></p>`,
+	},
+	"approval": {
+		`{{if .Subject}}{{.Subject}}{{else}}Approval required for workflow {{.WorkflowID}}{{end}}`,
+		`{{.Message}}
+<p>Approve: <a href="{{.ApproveURL}}">{{.ApproveURL}}</a></p>
+<p>Reject: <a href="{{.RejectURL}}">{{.RejectURL}}</a></p>
+<p>These links expire at {{.Expires.UTC.Format "2006-01-02 15:04 MST"}}</p>`,
+	},
+})
+
+func mustTemplates(emails map[string][2]string) *mail.Templates {
+	t := mail.NewTemplates("")
+	for name, e := range emails {
+		if err := t.Add(name, e[0], e[1], ""); err != nil {
+			panic(err)
+		}
+	}
+	return t
+}
+
+// sendTemplate renders the email from templates, falling back to the default, and sends it through m, or SES if m is nil
+func sendTemplate(cfg *amazon.Config, m mail.Mailer, templates *mail.Templates, name string, from string, to string, data interface{}) error {
+	if !templates.Has(name) {
+		templates = defaultTemplates
+	}
+	if m == nil {
+		m = &mail.SESMailer{Config: cfg}
+	}
+	return templates.Send(m, name, from, []string{to}, data)
+}
+
+// notificationData fills in the workflow details for a notification
+func (d *Decider) notificationData(dc *DecisionContext, reason string) *NotificationData {
+	return &NotificationData{
+		Reason:       reason,
+		Domain:       d.swfDomain,
+		WorkflowID:   dc.workflowID,
+		RunID:        dc.runID,
+		WorkflowType: dc.workflowType,
+		ConsoleURL:   d.consoleURL(dc),
+	}
+}